@@ -2,6 +2,7 @@
 package abi
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"math/big"
@@ -49,13 +50,18 @@ func Unpack(abi abi.ABI, v interface{}, name string, output string) error {
 
 // Call gets contract value with contract address and name
 func Call(abi abi.ABI, to, name string, inputs []interface{}) (resp json.RPCResponse, err error) {
+	return CallContext(context.Background(), abi, to, name, inputs)
+}
+
+// CallContext gets contract value as Call does on the chain carried by ctx until ctx is done
+func CallContext(ctx context.Context, abi abi.ABI, to, name string, inputs []interface{}) (resp json.RPCResponse, err error) {
 	data, err := Pack(abi, name, inputs...)
 	if err != nil {
 		return
 	}
 
-	r := rpc.GetInstance()
-	respStr, err := r.Call(to, data)
+	r := rpc.FromContext(ctx)
+	respStr, err := r.CallContext(ctx, to, data)
 	if err != nil {
 		return
 	}
@@ -66,14 +72,19 @@ func Call(abi abi.ABI, to, name string, inputs []interface{}) (resp json.RPCResp
 
 // SendTransaction calls smart contract with ABI using eth_sendTransaction
 func SendTransaction(abi abi.ABI, to, name string, inputs []interface{}, gas int) (resp json.RPCResponse, err error) {
+	return SendTransactionContext(context.Background(), abi, to, name, inputs, gas)
+}
+
+// SendTransactionContext calls smart contract as SendTransaction does on the chain carried by ctx
+func SendTransactionContext(ctx context.Context, abi abi.ABI, to, name string, inputs []interface{}, gas int) (resp json.RPCResponse, err error) {
 	var data string
 	if data, err = Pack(abi, name, inputs...); err != nil {
 		return
 	}
 
 	c := crypto.GetInstance()
-	r := rpc.GetInstance()
-	respStr, err := r.SendTransaction(c.GetAddress(), to, data, gas)
+	r := rpc.FromContext(ctx)
+	respStr, err := r.SendTransactionContext(ctx, c.GetAddress(), to, data, gas)
 	if err != nil {
 		return
 	}
@@ -84,18 +95,23 @@ func SendTransaction(abi abi.ABI, to, name string, inputs []interface{}, gas int
 
 // SendTransactionWithSign calls smart contract with ABI using eth_sendRawTransaction
 func SendTransactionWithSign(abi abi.ABI, to, name string, inputs []interface{}, gasLimit, gasPrice uint64) (resp json.RPCResponse, err error) {
+	return SendTransactionWithSignContext(context.Background(), abi, to, name, inputs, gasLimit, gasPrice)
+}
+
+// SendTransactionWithSignContext calls smart contract as SendTransactionWithSign does on the chain carried by ctx
+func SendTransactionWithSignContext(ctx context.Context, abi abi.ABI, to, name string, inputs []interface{}, gasLimit, gasPrice uint64) (resp json.RPCResponse, err error) {
 	var data []byte
 	if data, err = abi.Pack(name, inputs...); err != nil {
 		return
 	}
 
 	c := crypto.GetInstance()
-	r := rpc.GetInstance()
+	r := rpc.FromContext(ctx)
 
 	// Make TX function to get nonce
 	tx := func(nonce uint64) (err error) {
 		tx := types.NewTransaction(nonce, common.HexToAddress(to), zero, uint64(gasLimit), big.NewInt(int64(gasPrice)), data)
-		if tx, err = c.SignTx(tx); err != nil {
+		if tx, err = c.SignTxWith(tx, r.Signer()); err != nil {
 			return
 		}
 
@@ -105,7 +121,7 @@ func SendTransactionWithSign(abi abi.ABI, to, name string, inputs []interface{},
 		}
 
 		var respStr string
-		if respStr, err = r.SendRawTransaction(rlpTx); err != nil {
+		if respStr, err = r.SendRawTransactionContext(ctx, rlpTx); err != nil {
 			return
 		}
 
@@ -0,0 +1,254 @@
+// Package auth authenticates API keys and enforces per-key quotas
+//
+// Keys are given by [auth] of config file,
+// or looked up in DynamoDB when db of it is true.
+// Usage counters are kept by the same store so that quotas hold
+// across Lambda instances sharing the DynamoDB table.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	"github.com/hexoul/aws-lambda-eth-proxy/db"
+	"github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+)
+
+const (
+	// Header is HTTP header carrying API key
+	Header = "X-Api-Key"
+	// QueryParam is query parameter carrying API key for clients unable to set header
+	QueryParam = "apikey"
+	// Lifetime of cached key definition
+	keyCacheTTL = time.Minute
+)
+
+// Key is an API key and its permissions
+// Zero quota means unlimited and empty list means everything is allowed
+type Key = config.Key
+
+// Store looks up API keys and keeps usage counters
+type Store interface {
+	// GetKey returns Key or nil when it does not exist
+	GetKey(key string) (*Key, error)
+	// Incr adds n to counter and returns the sum
+	// The counter may be removed after expireAt
+	Incr(counter string, n uint64, expireAt time.Time) (uint64, error)
+}
+
+// Auth authenticates requests with Store
+type Auth struct {
+	store Store
+	now   func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedKey
+}
+
+// cachedKey is a key definition or its absence fetched from Store
+type cachedKey struct {
+	key       *Key
+	expiredAt time.Time
+}
+
+// ctxKey is a context key for Key
+type ctxKey struct{}
+
+// For singleton
+var (
+	instance *Auth
+	once     sync.Once
+	// mu guards instance replaced by Configure
+	mu         sync.RWMutex
+	configured bool
+)
+
+// GetInstance returns Auth of auth config, or default settings before Configure
+// It returns nil when no store is given, meaning authentication is disabled
+func GetInstance() *Auth {
+	once.Do(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if configured {
+			return
+		}
+		var err error
+		if instance, err = newAuth(config.Default().Auth, nil); err != nil {
+			log.Panic("Failed to load API keys, ", err)
+		}
+	})
+	mu.RLock()
+	defer mu.RUnlock()
+	return instance
+}
+
+// Configure replaces API keys
+// Usage counters are kept unless the store changes,
+// and the instance is kept when the new one cannot be made
+func Configure(cfg config.Auth) {
+	mu.Lock()
+	defer mu.Unlock()
+	a, err := newAuth(cfg, instance)
+	if err != nil {
+		log.Error("Failed to configure API keys, ", err)
+		return
+	}
+	instance, configured = a, true
+}
+
+// newAuth returns Auth of cfg, or nil when neither keys nor DB is given
+// Store of prev is kept when it is the same kind
+func newAuth(cfg config.Auth, prev *Auth) (*Auth, error) {
+	var prevStore Store
+	if prev != nil {
+		prevStore = prev.store
+	}
+	if cfg.DB {
+		if s, ok := prevStore.(*DBStore); ok {
+			return New(s), nil
+		}
+		dbHelper := db.GetInstance("")
+		if dbHelper == nil {
+			return nil, fmt.Errorf("auth: failed to connect DB")
+		}
+		return New(NewDBStore(dbHelper)), nil
+	}
+	if len(cfg.Keys) == 0 {
+		return nil, nil
+	}
+	if s, ok := prevStore.(*MemoryStore); ok {
+		if err := s.SetKeys(cfg.Keys); err != nil {
+			return nil, err
+		}
+		return New(s), nil
+	}
+	s, err := NewMemoryStore(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return New(s), nil
+}
+
+// New returns Auth using given Store
+func New(store Store) *Auth {
+	return &Auth{
+		store: store,
+		now:   time.Now,
+		cache: make(map[string]cachedKey),
+	}
+}
+
+// Authenticate validates API key and origin of a request
+func (a *Auth) Authenticate(apiKey, origin string) (*Key, *json.RPCError) {
+	if apiKey == "" {
+		return nil, json.NewRPCError(json.UnauthorizedCode, "API key is required")
+	}
+	key, err := a.getKey(apiKey)
+	if err != nil {
+		log.Error("auth: failed to get API key, ", err)
+		return nil, json.NewInternalError("failed to verify API key")
+	}
+	if key == nil {
+		return nil, json.NewRPCError(json.UnauthorizedCode, "invalid API key")
+	}
+	if !allowsOrigin(key, origin) {
+		return nil, json.NewRPCError(json.ForbiddenCode, fmt.Sprintf("origin %q is not allowed", origin))
+	}
+	return key, nil
+}
+
+// Authorize checks if the key may call the method and counts it against quotas
+func (a *Auth) Authorize(key *Key, method string) *json.RPCError {
+	if !allowsMethod(key, method) {
+		return json.NewRPCError(json.ForbiddenCode, fmt.Sprintf("the method %s is not allowed for this key", method))
+	}
+
+	now := a.now().UTC()
+	if key.PerSecondQuota > 0 {
+		sec := now.Truncate(time.Second)
+		cnt, err := a.store.Incr(key.Key+"/s/"+strconv.FormatInt(sec.Unix(), 10), 1, sec.Add(time.Minute))
+		if err != nil {
+			log.Error("auth: failed to count usage, ", err)
+		} else if cnt > key.PerSecondQuota {
+			return json.NewRateLimited("per-second quota exceeded", 1)
+		}
+	}
+	if key.DailyQuota > 0 {
+		day := now.Truncate(24 * time.Hour)
+		cnt, err := a.store.Incr(key.Key+"/d/"+day.Format("20060102"), 1, day.Add(48*time.Hour))
+		if err != nil {
+			log.Error("auth: failed to count usage, ", err)
+		} else if cnt > key.DailyQuota {
+			retryAfter := int(day.Add(24*time.Hour).Sub(now).Seconds()) + 1
+			return json.NewRateLimited("daily quota exceeded", retryAfter)
+		}
+	}
+	return nil
+}
+
+// getKey returns key definition from cache or Store
+func (a *Auth) getKey(apiKey string) (*Key, error) {
+	now := a.now()
+	a.mu.Lock()
+	c, ok := a.cache[apiKey]
+	a.mu.Unlock()
+	if ok && now.Before(c.expiredAt) {
+		return c.key, nil
+	}
+
+	key, err := a.store.GetKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.cache[apiKey] = cachedKey{key: key, expiredAt: now.Add(keyCacheTTL)}
+	a.mu.Unlock()
+	return key, nil
+}
+
+// allowsMethod reports whether the key may call the method
+func allowsMethod(k *Key, method string) bool {
+	if len(k.Methods) == 0 {
+		return true
+	}
+	for _, pattern := range k.Methods {
+		if matched, _ := path.Match(pattern, method); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOrigin reports whether the key may be used from the origin
+// A restricted key requires Origin header to be present
+func allowsOrigin(k *Key, origin string) bool {
+	if len(k.Origins) == 0 {
+		return true
+	}
+	for _, o := range k.Origins {
+		if o == "*" || (origin != "" && o == origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewContext returns context carrying authenticated Key
+func NewContext(ctx context.Context, key *Key) context.Context {
+	return context.WithValue(ctx, ctxKey{}, key)
+}
+
+// FromContext returns Key carried by context, or nil if there is none
+func FromContext(ctx context.Context) *Key {
+	if ctx == nil {
+		return nil
+	}
+	key, _ := ctx.Value(ctxKey{}).(*Key)
+	return key
+}
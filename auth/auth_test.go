@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	"github.com/hexoul/aws-lambda-eth-proxy/json"
+)
+
+var testKeys = []Key{
+	{Key: "free", DailyQuota: 3, PerSecondQuota: 2, Methods: []string{"eth_*", "net_version"}},
+	{Key: "dapp", Origins: []string{"https://dapp.example"}},
+	{Key: "any"},
+}
+
+func testAuth(t *testing.T) *Auth {
+	store, err := NewMemoryStore(testKeys)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %s", err)
+	}
+	return New(store)
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := testAuth(t)
+	tests := []struct {
+		key, origin string
+		code        int32
+	}{
+		{"", "", json.UnauthorizedCode},
+		{"unknown", "", json.UnauthorizedCode},
+		{"any", "", 0},
+		{"any", "https://evil.example", 0},
+		{"dapp", "https://dapp.example", 0},
+		{"dapp", "https://evil.example", json.ForbiddenCode},
+		{"dapp", "", json.ForbiddenCode},
+	}
+	for _, test := range tests {
+		key, err := a.Authenticate(test.key, test.origin)
+		if (test.code == 0 && (err != nil || key.Key != test.key)) || (test.code != 0 && (err == nil || err.Code != test.code)) {
+			t.Errorf("Unexpected result for %q from %q: %v", test.key, test.origin, err)
+		}
+	}
+
+	if _, err := NewMemoryStore([]Key{{}}); err == nil {
+		t.Errorf("Empty key should be rejected")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a := testAuth(t)
+	now := time.Date(2019, 3, 1, 23, 59, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+	key, _ := a.Authenticate("free", "")
+
+	if err := a.Authorize(key, "web3_clientVersion"); err == nil || err.Code != json.ForbiddenCode {
+		t.Errorf("Method out of the list should be forbidden: %v", err)
+	}
+
+	// Per-second quota
+	for i := 0; i < 2; i++ {
+		if err := a.Authorize(key, "eth_blockNumber"); err != nil {
+			t.Fatalf("Request within quota is rejected: %v", err)
+		}
+	}
+	err := a.Authorize(key, "net_version")
+	if err == nil || err.Code != json.RateLimitedCode || err.RetryAfter != 1 || err.HTTPStatus() != 429 {
+		t.Fatalf("Per-second quota should be enforced: %v", err)
+	}
+
+	// Request rejected by per-second quota is not counted for daily quota
+	now = now.Add(time.Second)
+	if err = a.Authorize(key, "eth_blockNumber"); err != nil {
+		t.Fatalf("Request within daily quota is rejected: %v", err)
+	}
+	err = a.Authorize(key, "eth_blockNumber")
+	if err == nil || err.Code != json.RateLimitedCode || err.RetryAfter != 60 {
+		t.Fatalf("Daily quota should be enforced: %v", err)
+	}
+
+	// Next day
+	now = now.Add(time.Minute)
+	if err = a.Authorize(key, "eth_blockNumber"); err != nil {
+		t.Errorf("Daily quota should be reset: %v", err)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	if GetInstance() != nil {
+		t.Errorf("Authentication should be disabled before Configure")
+	}
+
+	now := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	Configure(config.Auth{Keys: testKeys})
+	a := GetInstance()
+	a.now = func() time.Time { return now }
+	key, _ := a.Authenticate("free", "")
+	a.Authorize(key, "eth_blockNumber")
+	a.Authorize(key, "eth_blockNumber")
+
+	// Usage counters are kept while keys are replaced
+	Configure(config.Auth{Keys: testKeys[:1]})
+	a = GetInstance()
+	a.now = func() time.Time { return now }
+	if _, err := a.Authenticate("any", ""); err == nil {
+		t.Errorf("Removed key should be rejected")
+	}
+	if err := a.Authorize(key, "eth_blockNumber"); err == nil || err.Code != json.RateLimitedCode {
+		t.Errorf("Usage should be kept: %v", err)
+	}
+
+	if Configure(config.Auth{Keys: []Key{{}}}); GetInstance() != a {
+		t.Errorf("Invalid keys should not replace the instance")
+	}
+	if Configure(config.Auth{}); GetInstance() != nil {
+		t.Errorf("Authentication should be disabled without keys")
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != nil || FromContext(nil) != nil {
+		t.Errorf("Context without key should return nil")
+	}
+	key := &Key{Key: "any"}
+	if FromContext(NewContext(context.Background(), key)) != key {
+		t.Errorf("Failed to carry key in context")
+	}
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/common"
+	"github.com/hexoul/aws-lambda-eth-proxy/db"
+)
+
+// MemoryStore keeps keys and usage counters in memory
+// Counters are per process, so DBStore should be used for Lambda
+type MemoryStore struct {
+	mu       sync.Mutex
+	keys     map[string]*Key
+	counters map[string]*counter
+}
+
+// counter is a usage counter of MemoryStore
+type counter struct {
+	n        uint64
+	expireAt time.Time
+}
+
+// NewMemoryStore returns MemoryStore having given keys
+func NewMemoryStore(keys []Key) (*MemoryStore, error) {
+	s := &MemoryStore{counters: make(map[string]*counter)}
+	if err := s.SetKeys(keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetKeys replaces keys keeping usage counters
+func (s *MemoryStore) SetKeys(keys []Key) error {
+	m := make(map[string]*Key, len(keys))
+	for i := range keys {
+		if keys[i].Key == "" {
+			return fmt.Errorf("auth: key %d is empty", i)
+		}
+		k := keys[i]
+		m[k.Key] = &k
+	}
+	s.mu.Lock()
+	s.keys = m
+	s.mu.Unlock()
+	return nil
+}
+
+// GetKey returns Key or nil when it does not exist
+func (s *MemoryStore) GetKey(key string) (*Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[key], nil
+}
+
+// Incr adds n to counter and returns the sum
+func (s *MemoryStore) Incr(name string, n uint64, expireAt time.Time) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Counter name identifies its time window, so expiry only matters for cleanup
+	c := s.counters[name]
+	if c == nil {
+		// Sweep expired counters from time to time not to grow forever
+		if len(s.counters) >= 1024 {
+			now := time.Now()
+			for k, v := range s.counters {
+				if now.After(v.expireAt) {
+					delete(s.counters, k)
+				}
+			}
+		}
+		c = &counter{expireAt: expireAt}
+		s.counters[name] = c
+	}
+	c.n += n
+	return c.n, nil
+}
+
+// DBStore keeps keys and usage counters in DynamoDB
+// Usage table should enable TTL on DbAPIUsageExpireName column
+type DBStore struct {
+	dbHelper *db.DynamoDBHelper
+}
+
+// NewDBStore returns DBStore using given DB helper
+func NewDBStore(dbHelper *db.DynamoDBHelper) *DBStore {
+	return &DBStore{dbHelper: dbHelper}
+}
+
+// GetKey returns Key or nil when it does not exist
+func (s *DBStore) GetKey(key string) (*Key, error) {
+	item, err := s.dbHelper.GetItemByKey(common.DbAPIKeyTblName, common.DbAPIKeyPropName, key)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	var k Key
+	s.dbHelper.UnmarshalMap(item, &k)
+	if k.Key != key {
+		return nil, nil
+	}
+	return &k, nil
+}
+
+// Incr adds n to counter and returns the sum
+// DynamoDB updates it atomically so that every Lambda instance shares it
+func (s *DBStore) Incr(name string, n uint64, expireAt time.Time) (uint64, error) {
+	cnt, err := s.dbHelper.AddCounter(common.DbAPIUsageTblName, common.DbAPIUsagePropName, name,
+		common.DbAPIUsageCountName, int64(n), common.DbAPIUsageExpireName, expireAt.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return uint64(cnt), nil
+}
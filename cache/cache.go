@@ -0,0 +1,327 @@
+// Package cache keeps responses of Ether node following method-aware rules
+//
+// Results which never change, such as chain ID or a block by hash,
+// are kept until evicted. Results changing every block, such as
+// eth_blockNumber, are kept for a short TTL. Other methods including
+// every write are never cached.
+// Responses are kept in memory by default, or in DynamoDB when db of cache config is true
+// so that Lambda instances share them.
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	"github.com/hexoul/aws-lambda-eth-proxy/db"
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+	"github.com/hexoul/aws-lambda-eth-proxy/metrics"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Store keeps responses
+type Store interface {
+	// Get returns a response or false when it does not exist or is expired
+	Get(key string) ([]byte, bool, error)
+	// Set keeps a response until expireAt, zero time means no expiry
+	Set(key string, val []byte, expireAt time.Time) error
+}
+
+// Cache decides which response to keep and serves it from Store
+type Cache struct {
+	cfg   config.Cache
+	store Store
+	now   func() time.Time
+
+	// head returns the latest block number of the chain in ctx
+	head  func(ctx context.Context) (uint64, error)
+	mu    sync.Mutex
+	heads map[string]cachedHead
+
+	hits   uint64
+	misses uint64
+}
+
+// cachedHead is the latest block number of a chain
+type cachedHead struct {
+	number    uint64
+	expiredAt time.Time
+}
+
+// rule decides if a result of method is immutable
+// It returns false when the result may change later
+type rule func(c *Cache, ctx context.Context, chain string, params []interface{}, result json.RawMessage) bool
+
+// immutables are methods whose result never changes once it is given
+var immutables = map[string]rule{
+	"eth_chainId":                             always,
+	"net_version":                             always,
+	"eth_getBlockByHash":                      always,
+	"eth_getBlockTransactionCountByHash":      always,
+	"eth_getTransactionByBlockHashAndIndex":   always,
+	"eth_getUncleByBlockHashAndIndex":         always,
+	"eth_getUncleCountByBlockHash":            always,
+	"eth_getTransactionByHash":                (*Cache).mined,
+	"eth_getTransactionReceipt":               (*Cache).mined,
+	"eth_getBlockByNumber":                    (*Cache).deepBlock,
+	"eth_getBlockTransactionCountByNumber":    (*Cache).deepBlock,
+	"eth_getTransactionByBlockNumberAndIndex": (*Cache).deepBlock,
+	"eth_getUncleByBlockNumberAndIndex":       (*Cache).deepBlock,
+	"eth_getUncleCountByBlockNumber":          (*Cache).deepBlock,
+}
+
+// For singleton
+var (
+	instance *Cache
+	once     sync.Once
+	// mu guards instances and settings replaced by Configure
+	mu       sync.RWMutex
+	settings = config.Default().Cache
+	// last is the latest Cache made, which is kept while cache is disabled
+	last       *Cache
+	configured bool
+)
+
+// For metrics
+var (
+	cacheHits     = metrics.GetInstance().Counter("eth_proxy_cache_hits_total", "Responses served from cache")
+	cacheMisses   = metrics.GetInstance().Counter("eth_proxy_cache_misses_total", "Responses not found in cache")
+	cacheHitRatio = metrics.GetInstance().Gauge("eth_proxy_cache_hit_ratio", "Hits over lookups of cache")
+)
+
+func init() {
+	metrics.GetInstance().OnCollect(func() {
+		mu.RLock()
+		c := instance
+		mu.RUnlock()
+		if c != nil {
+			c.collect()
+		}
+	})
+}
+
+// GetInstance returns Cache of cache config, or default settings before Configure
+// It returns nil when the size is zero, meaning cache is disabled
+func GetInstance() *Cache {
+	once.Do(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if configured {
+			return
+		}
+		var err error
+		if instance, err = newCache(settings, nil); err != nil {
+			log.Panic("Failed to load cache, ", err)
+		}
+		last = instance
+	})
+	mu.RLock()
+	defer mu.RUnlock()
+	return instance
+}
+
+// Configure replaces settings of cache
+// Responses kept are still served unless size or store changes,
+// and the instance is kept when the new one cannot be made
+func Configure(cfg config.Cache) {
+	mu.Lock()
+	defer mu.Unlock()
+	c, err := newCache(cfg, last)
+	if err != nil {
+		log.Error("Failed to configure cache, ", err)
+		return
+	}
+	settings, instance, configured = cfg, c, true
+	if c != nil {
+		last = c
+	}
+}
+
+// newCache returns Cache of cfg, or nil when the size is zero
+// Store, head and stats of prev are kept when it has the same size and store
+func newCache(cfg config.Cache, prev *Cache) (*Cache, error) {
+	if cfg.Size == 0 {
+		return nil, nil
+	}
+	var store Store
+	if prev != nil && prev.cfg.Size == cfg.Size && prev.cfg.DB == cfg.DB {
+		store = prev.store
+	} else if cfg.DB {
+		dbHelper := db.GetInstance("")
+		if dbHelper == nil {
+			return nil, fmt.Errorf("cache: failed to connect DB")
+		}
+		store = NewDBStore(dbHelper)
+	} else {
+		store = NewMemoryStore(cfg.Size)
+	}
+	c, err := New(cfg, store)
+	if err != nil || prev == nil {
+		return c, err
+	}
+	c.head = prev.head
+	c.hits, c.misses = prev.Stats()
+	return c, nil
+}
+
+// New validates cfg and returns Cache using given Store
+func New(cfg config.Cache, store Store) (*Cache, error) {
+	for method, ttl := range cfg.TTL {
+		// Writes are never cached
+		if !ethjson.IsIdempotent(method) || ttl < 0 {
+			return nil, fmt.Errorf("cache: invalid ttl of %s", method)
+		}
+	}
+	return &Cache{
+		cfg:   cfg,
+		store: store,
+		now:   time.Now,
+		heads: make(map[string]cachedHead),
+	}, nil
+}
+
+// SetHead sets a function returning the latest block number of the chain in ctx
+// Without it, results of recent blocks cannot be told from deep ones and are not cached
+func (c *Cache) SetHead(head func(ctx context.Context) (uint64, error)) {
+	c.head = head
+}
+
+// Cacheable returns true if a result of method may be cached
+func (c *Cache) Cacheable(method string) bool {
+	_, ok := immutables[method]
+	return ok || c.cfg.TTL[method] > 0
+}
+
+// Do returns a response of req on chain from Store
+// or invokes fetch and keeps its response when it is cacheable
+// The response keeps id of the request it was fetched for
+func (c *Cache) Do(ctx context.Context, chain string, req ethjson.RPCRequest, fetch func() (string, error)) (string, error) {
+	if !c.Cacheable(req.Method) {
+		return fetch()
+	}
+
+	key := Key(chain, req)
+	if val, ok, err := c.store.Get(key); err != nil {
+		log.Error("cache: failed to get, ", err)
+	} else if ok {
+		atomic.AddUint64(&c.hits, 1)
+		cacheHits.Inc()
+		return string(val), nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+	cacheMisses.Inc()
+
+	resp, err := fetch()
+	if err != nil {
+		return resp, err
+	}
+	if expireAt, ok := c.expiry(ctx, chain, req, []byte(resp)); ok {
+		if err := c.store.Set(key, []byte(resp), expireAt); err != nil {
+			log.Error("cache: failed to set, ", err)
+		}
+	}
+	return resp, nil
+}
+
+// expiry returns when the response expires, or false when it is not to be cached
+// Error response and null result are never cached
+func (c *Cache) expiry(ctx context.Context, chain string, req ethjson.RPCRequest, resp []byte) (time.Time, bool) {
+	var body struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(resp, &body); err != nil || len(body.Error) > 0 ||
+		len(body.Result) == 0 || string(body.Result) == "null" {
+		return time.Time{}, false
+	}
+
+	if r, ok := immutables[req.Method]; ok && r(c, ctx, chain, req.Params, body.Result) {
+		return time.Time{}, true
+	}
+	if ttl := c.cfg.TTL[req.Method]; ttl > 0 {
+		return c.now().Add(time.Duration(ttl) * time.Millisecond), true
+	}
+	return time.Time{}, false
+}
+
+// Stats returns the number of hits and misses
+func (c *Cache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// collect updates the hit ratio, while counters of hits and misses are increased on lookups
+func (c *Cache) collect() {
+	hits, misses := c.Stats()
+	if hits+misses > 0 {
+		cacheHitRatio.Set(float64(hits) / float64(hits+misses))
+	}
+}
+
+// always means the result is immutable
+func always(*Cache, context.Context, string, []interface{}, json.RawMessage) bool {
+	return true
+}
+
+// mined checks if the transaction is in a block deep enough
+func (c *Cache) mined(ctx context.Context, chain string, params []interface{}, result json.RawMessage) bool {
+	var tx struct {
+		BlockNumber *hexutil.Uint64 `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(result, &tx); err != nil || tx.BlockNumber == nil {
+		// Pending
+		return false
+	}
+	return c.deep(ctx, chain, uint64(*tx.BlockNumber))
+}
+
+// deepBlock checks if the block given by number as the first param is deep enough
+// Block tags such as "latest" are not
+func (c *Cache) deepBlock(ctx context.Context, chain string, params []interface{}, result json.RawMessage) bool {
+	if len(params) == 0 {
+		return false
+	}
+	s, _ := params[0].(string)
+	number, err := hexutil.DecodeUint64(s)
+	if err != nil {
+		return false
+	}
+	return c.deep(ctx, chain, number)
+}
+
+// deep checks if the block has enough confirmations not to be reorganized
+// The head is kept as long as eth_blockNumber is
+func (c *Cache) deep(ctx context.Context, chain string, number uint64) bool {
+	if c.head == nil {
+		return false
+	}
+	now := c.now()
+	c.mu.Lock()
+	h, ok := c.heads[chain]
+	c.mu.Unlock()
+	if !ok || now.After(h.expiredAt) {
+		n, err := c.head(ctx)
+		if err != nil {
+			return false
+		}
+		ttl := time.Duration(c.cfg.TTL["eth_blockNumber"]) * time.Millisecond
+		h = cachedHead{number: n, expiredAt: now.Add(ttl)}
+		c.mu.Lock()
+		c.heads[chain] = h
+		c.mu.Unlock()
+	}
+	return h.number >= number+c.cfg.Confirmations
+}
+
+// Key returns a key identifying req on chain regardless of its id
+func Key(chain string, req ethjson.RPCRequest) string {
+	sum := sha256.Sum256([]byte(chain + "\x00" + req.Canonical()))
+	return hex.EncodeToString(sum[:])
+}
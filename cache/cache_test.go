@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	"github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/metrics"
+)
+
+func req(method string, params ...interface{}) json.RPCRequest {
+	return json.RPCRequest{Jsonrpc: json.Version, Method: method, Params: params, ID: []byte("1")}
+}
+
+func result(v string) string {
+	return fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":%s}`, v)
+}
+
+// counter returns the value of metric without labels
+func counter(name string) float64 {
+	var buf bytes.Buffer
+	metrics.GetInstance().WriteText(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			v, _ := strconv.ParseFloat(strings.TrimPrefix(line, name+" "), 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func newTestCache(t *testing.T) (*Cache, *MemoryStore, *time.Time) {
+	now := time.Unix(1500000000, 0)
+	store := NewMemoryStore(10)
+	store.now = func() time.Time { return now }
+	c, err := New(config.Default().Cache, store)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	c.now = store.now
+	c.SetHead(func(context.Context) (uint64, error) { return 1000, nil })
+	return c, store, &now
+}
+
+func TestDo(t *testing.T) {
+	c, store, now := newTestCache(t)
+	tests := []struct {
+		req    json.RPCRequest
+		resp   string
+		cached bool
+	}{
+		{req("eth_chainId"), result(`"0x1"`), true},
+		{req("eth_blockNumber"), result(`"0x3e8"`), true},
+		{req("eth_getBlockByHash", "0xab", false), result(`{"number":"0x1"}`), true},
+		{req("eth_getBlockByHash", "0xcd", false), result(`null`), false},
+		{req("eth_getBlockByNumber", "0x1", false), result(`{"number":"0x1"}`), true},
+		{req("eth_getBlockByNumber", "0x3e0", false), result(`{"number":"0x3e0"}`), false},
+		{req("eth_getBlockByNumber", "latest", false), result(`{"number":"0x3e8"}`), false},
+		{req("eth_getTransactionReceipt", "0x01"), result(`{"blockNumber":"0x10"}`), true},
+		{req("eth_getTransactionReceipt", "0x02"), result(`{"blockNumber":null}`), false},
+		{req("eth_call", map[string]string{"to": "0x1"}, "latest"), result(`"0x"`), false},
+		{req("eth_sendRawTransaction", "0x00"), result(`"0x12"`), false},
+		{req("net_version"), `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"down"}}`, false},
+	}
+	for _, test := range tests {
+		fetched := 0
+		fetch := func() (string, error) {
+			fetched++
+			return test.resp, nil
+		}
+		for i := 0; i < 2; i++ {
+			if resp, err := c.Do(nil, "mainnet", test.req, fetch); err != nil || resp != test.resp {
+				t.Errorf("Unexpected response of %s: %s %v", test.req.Method, resp, err)
+			}
+		}
+		if cached := fetched == 1; cached != test.cached {
+			t.Errorf("%s %v should be cached %v", test.req.Method, test.req.Params, test.cached)
+		}
+	}
+
+	// Results of other chain are not shared
+	fetched := false
+	c.Do(nil, "testnet", req("eth_chainId"), func() (string, error) {
+		fetched = true
+		return result(`"0x3"`), nil
+	})
+	if !fetched {
+		t.Errorf("Chains should not share cache")
+	}
+
+	// TTL expires
+	*now = now.Add(2 * time.Second)
+	if _, ok, _ := store.Get(Key("mainnet", req("eth_blockNumber"))); ok {
+		t.Errorf("eth_blockNumber should be expired")
+	}
+	if _, ok, _ := store.Get(Key("mainnet", req("eth_chainId"))); !ok {
+		t.Errorf("eth_chainId should not be expired")
+	}
+
+	if hits, misses := c.Stats(); hits != 5 || misses != 16 {
+		t.Errorf("Unexpected stats: %d hits, %d misses", hits, misses)
+	}
+}
+
+func TestKey(t *testing.T) {
+	a := req("eth_call", map[string]interface{}{"to": "0x1", "data": "0x2"}, "latest")
+	b := req("eth_call", map[string]interface{}{"data": "0x2", "to": "0x1"}, "latest")
+	b.ID = []byte("2")
+	if Key("mainnet", a) != Key("mainnet", b) {
+		t.Errorf("Key should not depend on id and order of object keys")
+	}
+	if Key("mainnet", a) == Key("testnet", a) || Key("mainnet", a) == Key("mainnet", req("eth_call")) {
+		t.Errorf("Key should depend on chain and params")
+	}
+
+	if _, err := New(config.Cache{TTL: map[string]int{"eth_sendRawTransaction": 1000}}, nil); err == nil {
+		t.Errorf("Write should not be cached")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	fetches := 0
+	fetch := func() (string, error) {
+		fetches++
+		return result(`"0x1"`), nil
+	}
+	cfg := config.Default().Cache
+	cfg.Size = 10
+	Configure(cfg)
+	c := GetInstance()
+	if c == nil {
+		t.Fatalf("Cache should be configured")
+	}
+	c.SetHead(func(context.Context) (uint64, error) { return 1000, nil })
+	c.Do(context.Background(), "test", req("eth_chainId"), fetch)
+
+	// Responses and head are kept unless size or store changes
+	cfg.TTL = map[string]int{"eth_gasPrice": 1000}
+	Configure(cfg)
+	if c = GetInstance(); c.Cacheable("eth_blockNumber") || c.head == nil {
+		t.Errorf("Settings should be replaced with head kept")
+	}
+	c.Do(context.Background(), "test", req("eth_chainId"), fetch)
+	if fetches != 1 {
+		t.Errorf("Responses should be kept: %d fetches", fetches)
+	}
+
+	cfg.Size = 0
+	if Configure(cfg); GetInstance() != nil {
+		t.Errorf("Zero size should disable cache")
+	}
+	cfg.Size = 20
+	if Configure(cfg); GetInstance() == nil || GetInstance().head == nil {
+		t.Errorf("Cache should be enabled again with head")
+	}
+
+	// Counters never go backwards across configurations
+	hits, misses := counter("eth_proxy_cache_hits_total"), counter("eth_proxy_cache_misses_total")
+	cfg.DB, cfg.Size = false, 30
+	Configure(cfg)
+	c = GetInstance()
+	c.hits, c.misses = 0, 0
+	c.Do(context.Background(), "test", req("eth_chainId"), fetch)
+	c.Do(context.Background(), "test", req("eth_chainId"), fetch)
+	if counter("eth_proxy_cache_hits_total") != hits+1 || counter("eth_proxy_cache_misses_total") != misses+1 {
+		t.Errorf("Counters should be increased on lookups")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(2)
+	s.Set("a", []byte("1"), time.Time{})
+	s.Set("b", []byte("2"), time.Time{})
+	s.Get("a")
+	s.Set("c", []byte("3"), time.Time{})
+	if _, ok, _ := s.Get("b"); ok {
+		t.Errorf("Least recently used should be evicted")
+	}
+	if v, ok, _ := s.Get("a"); !ok || string(v) != "1" {
+		t.Errorf("Recently used should be kept")
+	}
+	if s.Len() != 2 {
+		t.Errorf("Unexpected length %d", s.Len())
+	}
+}
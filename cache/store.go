@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/common"
+	"github.com/hexoul/aws-lambda-eth-proxy/db"
+)
+
+// MemoryStore keeps responses in memory evicting the least recently used one
+// Responses are per process, so DBStore should be used to share them among Lambda
+type MemoryStore struct {
+	size int
+	now  func() time.Time
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+// entry is a response of MemoryStore
+type entry struct {
+	key      string
+	val      []byte
+	expireAt time.Time
+}
+
+// NewMemoryStore returns MemoryStore keeping size responses at most
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{
+		size:  size,
+		now:   time.Now,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// Get returns a response or false when it does not exist or is expired
+func (s *MemoryStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := elem.Value.(*entry)
+	if !e.expireAt.IsZero() && s.now().After(e.expireAt) {
+		s.lru.Remove(elem)
+		delete(s.items, key)
+		return nil, false, nil
+	}
+	s.lru.MoveToFront(elem)
+	return e.val, true, nil
+}
+
+// Set keeps a response until expireAt, zero time means no expiry
+func (s *MemoryStore) Set(key string, val []byte, expireAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		elem.Value = &entry{key: key, val: val, expireAt: expireAt}
+		s.lru.MoveToFront(elem)
+		return nil
+	}
+	s.items[key] = s.lru.PushFront(&entry{key: key, val: val, expireAt: expireAt})
+	for s.lru.Len() > s.size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.items, oldest.Value.(*entry).key)
+	}
+	return nil
+}
+
+// Len returns the number of responses kept
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// DBStore keeps responses in DynamoDB
+// Cache table should enable TTL on DbCacheExpireName column
+type DBStore struct {
+	dbHelper *db.DynamoDBHelper
+	now      func() time.Time
+}
+
+// dbItem is a response in cache table
+type dbItem struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	// ExpireAt is unix time, zero means no expiry
+	ExpireAt int64 `json:"expireAt,omitempty"`
+}
+
+// NewDBStore returns DBStore using given DB helper
+func NewDBStore(dbHelper *db.DynamoDBHelper) *DBStore {
+	return &DBStore{dbHelper: dbHelper, now: time.Now}
+}
+
+// Get returns a response or false when it does not exist or is expired
+// Expiry is checked here because DynamoDB TTL removes items lazily
+func (s *DBStore) Get(key string) ([]byte, bool, error) {
+	item, err := s.dbHelper.GetItemByKey(common.DbCacheTblName, common.DbCachePropName, key)
+	if err != nil || item == nil {
+		return nil, false, err
+	}
+	var i dbItem
+	s.dbHelper.UnmarshalMap(item, &i)
+	if i.Key != key || (i.ExpireAt != 0 && s.now().Unix() >= i.ExpireAt) {
+		return nil, false, nil
+	}
+	return i.Value, true, nil
+}
+
+// Set keeps a response until expireAt, zero time means no expiry
+func (s *DBStore) Set(key string, val []byte, expireAt time.Time) error {
+	i := dbItem{Key: key, Value: val}
+	if !expireAt.IsZero() {
+		i.ExpireAt = expireAt.Unix()
+	}
+	return s.dbHelper.PutItem(common.DbCacheTblName, i)
+}
@@ -16,3 +16,27 @@ const (
 	// DbConfigValName is a value colum name
 	DbConfigValName = "Value"
 )
+
+const (
+	// DbAPIKeyTblName is an API key table name
+	DbAPIKeyTblName = "ApiKey"
+	// DbAPIKeyPropName is a partition key column name of API key table
+	DbAPIKeyPropName = "key"
+	// DbAPIUsageTblName is an API key usage counter table name
+	DbAPIUsageTblName = "ApiKeyUsage"
+	// DbAPIUsagePropName is a partition key column name of usage counter table
+	DbAPIUsagePropName = "counter"
+	// DbAPIUsageCountName is a count column name
+	DbAPIUsageCountName = "count"
+	// DbAPIUsageExpireName is a TTL column name in unix time
+	DbAPIUsageExpireName = "expireAt"
+)
+
+const (
+	// DbCacheTblName is an RPC response cache table name
+	DbCacheTblName = "RpcCache"
+	// DbCachePropName is a partition key column name of cache table
+	DbCachePropName = "key"
+	// DbCacheExpireName is a TTL column name in unix time
+	DbCacheExpireName = "expireAt"
+)
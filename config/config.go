@@ -0,0 +1,702 @@
+// Package config loads deployment settings from TOML file
+// and environment variables overriding it
+//
+//	network = "testnet"
+//	port = 8545
+//
+//	[rpc]
+//	testnet_urls = ["https://ropsten.infura.io"]
+//	testnet_ws_urls = ["wss://ropsten.infura.io/ws"]
+//	timeout = 5
+//	testnet_strategy = "round-robin"
+//
+//	[chains.137]
+//	chain_id = 137
+//	urls = ["https://polygon-rpc.com", "https://polygon.example"]
+//	strategy = "weighted"
+//	weights = [9, 1]
+//
+//	[[chains.137.upstreams]]
+//	url = "https://polygon.provider.example"
+//	auth = "bearer"
+//	token = "secret"
+//	weight = 3
+//	archive = true
+//
+//	[cache]
+//	size = 10000
+//	ttl = { eth_blockNumber = 1000 }
+//
+//	[policy]
+//	deny = ["personal_*", "admin_*", "debug_*", "miner_*"]
+//	constraints = { eth_getLogs = { max_block_range = 10000 } }
+//
+//	[[auth.keys]]
+//	key = "dapp"
+//	daily_quota = 100000
+//
+//	[limit]
+//	rate = 50
+//	burst = 100
+//	weights = { eth_getLogs = 10, "debug_*" = 20 }
+//
+//	[ipfs]
+//	urls = ["localhost:5001"]
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+
+	"github.com/BurntSushi/toml"
+)
+
+// For environment arguments
+const (
+	// Path means a location of config file in file system
+	Path = "CONFIG_PATH"
+)
+
+// Networks
+const (
+	// Mainnet targets main network
+	Mainnet = "mainnet"
+	// Testnet targets test network
+	Testnet = "testnet"
+)
+
+// Strategies to choose a node among the pool of a chain
+const (
+	// Random picks a node uniformly at random
+	Random = "random"
+	// RoundRobin picks nodes in turn
+	RoundRobin = "round-robin"
+	// Weighted picks nodes in turn in proportion to their weights
+	Weighted = "weighted"
+	// LeastLatency picks a node having the least average latency
+	LeastLatency = "least-latency"
+	// LeastInFlight picks a node having the least requests in flight
+	LeastInFlight = "least-in-flight"
+)
+
+// Authentications of upstream
+const (
+	// AuthBasic sends username and password by basic authentication
+	AuthBasic = "basic"
+	// AuthBearer sends token as bearer token
+	AuthBearer = "bearer"
+	// AuthProjectSecret sends token as password of basic authentication without username as Infura does
+	AuthProjectSecret = "project-secret"
+	// AuthJWT sends JWT signed with token, a secret in hex, as Engine API does
+	AuthJWT = "jwt"
+)
+
+// Actions of policy
+const (
+	// Allow relays a method
+	Allow = "allow"
+	// Deny rejects a method
+	Deny = "deny"
+)
+
+// upstreamSchemes are schemes of upstream URL
+// ws and wss are WebSocket, and unix is IPC socket of node such as unix:///var/run/geth.ipc
+var upstreamSchemes = []string{"http", "https", "ws", "wss", "unix"}
+
+// auths are known authentications, blank means none
+var auths = map[string]bool{
+	"":                true,
+	AuthBasic:         true,
+	AuthBearer:        true,
+	AuthProjectSecret: true,
+	AuthJWT:           true,
+}
+
+// strategies are known strategies
+var strategies = map[string]bool{
+	Random:        true,
+	RoundRobin:    true,
+	Weighted:      true,
+	LeastLatency:  true,
+	LeastInFlight: true,
+}
+
+// Config is settings of deployment
+type Config struct {
+	// Network is a name of default chain such as mainnet or testnet
+	Network string `toml:"network"`
+	// Port is listened in HTTP mode
+	Port int `toml:"port"`
+	RPC  RPC `toml:"rpc"`
+	// Chains is chain name => chain served at /chain/{name}
+	Chains map[string]Chain `toml:"chains"`
+	Cache  Cache            `toml:"cache"`
+	Policy Policy           `toml:"policy"`
+	Auth   Auth             `toml:"auth"`
+	Limit  Limit            `toml:"limit"`
+	IPFS   IPFS             `toml:"ipfs"`
+}
+
+// Chain is settings of a chain
+type Chain struct {
+	// ChainID is expected chain ID, zero means it is resolved from node
+	ChainID uint64   `toml:"chain_id"`
+	Urls    []string `toml:"urls"`
+	WsUrls  []string `toml:"ws_urls"`
+	// Strategy chooses a node, blank means random
+	Strategy string `toml:"strategy"`
+	// Weights are weights of urls in the same order for weighted strategy
+	// Blank means every node has the same weight
+	Weights []int `toml:"weights"`
+	// Upstreams are nodes having their own settings in addition to urls
+	Upstreams []Upstream `toml:"upstreams"`
+}
+
+// Upstream is an Ether node with settings of requests to it
+type Upstream struct {
+	URL string `toml:"url"`
+	// Headers are sent with every request
+	Headers map[string]string `toml:"headers"`
+	// Auth is one of authentications, blank means none
+	Auth     string `toml:"auth"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// Token is a bearer token, project secret or JWT secret following Auth
+	Token string `toml:"token"`
+	// Weight is for weighted strategy, zero means 1
+	Weight int `toml:"weight"`
+	// Timeout is HTTP timeout in second, zero means timeout of rpc
+	Timeout int `toml:"timeout"`
+	// Archive tells the node keeps state of every block, otherwise it is a full node
+	Archive bool `toml:"archive"`
+}
+
+// String returns the upstream without credentials to be logged
+// URL keeps its scheme and host only since its path and query may have an API key
+func (u Upstream) String() string {
+	s := "invalid url"
+	if parsed, err := url.Parse(u.URL); err == nil {
+		s = parsed.Scheme + "://" + parsed.Host
+		if parsed.Scheme == "unix" {
+			s += parsed.Path
+		}
+	}
+	if u.Auth != "" {
+		s += " (" + u.Auth + ")"
+	}
+	return s
+}
+
+// AllUpstreams returns nodes of urls with their weights followed by upstreams
+func (c Chain) AllUpstreams() []Upstream {
+	ups := make([]Upstream, 0, len(c.Urls)+len(c.Upstreams))
+	for i, u := range c.Urls {
+		up := Upstream{URL: u}
+		if i < len(c.Weights) {
+			up.Weight = c.Weights[i]
+		}
+		ups = append(ups, up)
+	}
+	return append(ups, c.Upstreams...)
+}
+
+// RPC is settings of Ether nodes
+// Mainnet and testnet URLs define chains named mainnet and testnet
+type RPC struct {
+	MainnetUrls   []string `toml:"mainnet_urls"`
+	TestnetUrls   []string `toml:"testnet_urls"`
+	MainnetWsUrls []string `toml:"mainnet_ws_urls"`
+	TestnetWsUrls []string `toml:"testnet_ws_urls"`
+	// Strategies and weights of mainnet and testnet as Chain has
+	MainnetStrategy string `toml:"mainnet_strategy"`
+	TestnetStrategy string `toml:"testnet_strategy"`
+	MainnetWeights  []int  `toml:"mainnet_weights"`
+	TestnetWeights  []int  `toml:"testnet_weights"`
+	// Upstreams of mainnet and testnet in addition to urls
+	MainnetUpstreams []Upstream `toml:"mainnet_upstreams"`
+	TestnetUpstreams []Upstream `toml:"testnet_upstreams"`
+	// Timeout is HTTP timeout in second
+	Timeout int `toml:"timeout"`
+	// RetryCount is the number of attempts for a request
+	RetryCount int `toml:"retry_count"`
+	// RetryBackoff is milliseconds to wait before the first retry, doubled every retry
+	RetryBackoff int `toml:"retry_backoff"`
+	// FailThreshold is failures to exclude a node
+	FailThreshold int `toml:"fail_threshold"`
+	// Cooldown is seconds for an excluded node to be probed again,
+	// which is also half-life of its failures
+	Cooldown int `toml:"cooldown"`
+	// MaxLag is blocks for a node to be behind the best one before being excluded
+	MaxLag int `toml:"max_lag"`
+	// HeadInterval is seconds to poll head block of nodes, zero disables it
+	HeadInterval int `toml:"head_interval"`
+	// ArchiveDepth is blocks behind the best head whose state full nodes keep,
+	// and a state query of an older block goes to archive nodes
+	ArchiveDepth int `toml:"archive_depth"`
+	// HedgePercentile is a percentile of latency for a read to be sent to another node
+	// when the first one has not answered, zero disables hedging
+	HedgePercentile float64 `toml:"hedge_percentile"`
+	// Quorum is the number of nodes asked for a read of QuorumMethods,
+	// whose majority must agree on the result
+	Quorum int `toml:"quorum"`
+	// QuorumMethods are method names or globs read by quorum
+	QuorumMethods []string `toml:"quorum_methods"`
+}
+
+// chainName is a name usable as URL path segment
+var chainName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedNames are path segments not to be chain names
+var reservedNames = map[string]bool{
+	"chain":   true,
+	"ws":      true,
+	"metrics": true,
+	"health":  true,
+	"ready":   true,
+}
+
+// Cache is settings of response cache
+type Cache struct {
+	// Size is the number of responses kept in memory, zero disables cache
+	Size int `toml:"size"`
+	// TTL is method => milliseconds to keep a result changing every block
+	TTL map[string]int `toml:"ttl"`
+	// Confirmations is the depth of a block not to be reorganized
+	Confirmations uint64 `toml:"confirmations"`
+	// DB keeps responses in DynamoDB to share them among Lambda instances
+	DB bool `toml:"db"`
+}
+
+// Policy is settings of methods relayed or rejected ahead of relaying them
+type Policy struct {
+	// Default is an action for a method matched with no rule, blank means allow
+	Default string `toml:"default"`
+	// Allow is a list of method names or globs to be relayed
+	Allow []string `toml:"allow"`
+	// Deny is a list of method names or globs to be rejected
+	Deny []string `toml:"deny"`
+	// Constraints is method => limits of its parameters
+	Constraints map[string]Constraint `toml:"constraints"`
+}
+
+// Constraint limits parameters of a method
+// Zero value means no limit
+type Constraint struct {
+	// MaxBlockRange caps toBlock - fromBlock of a filter such as eth_getLogs
+	MaxBlockRange uint64 `toml:"max_block_range"`
+	// MaxAddresses caps the number of addresses of a filter
+	MaxAddresses int `toml:"max_addresses"`
+}
+
+// Auth is settings of API keys
+// Authentication is disabled when neither keys nor DB is given
+type Auth struct {
+	// Keys are API keys kept in memory with usage counters per process
+	Keys []Key `toml:"keys"`
+	// DB looks up API keys in DynamoDB, whose usage counters are shared among Lambda instances
+	DB bool `toml:"db"`
+}
+
+// Key is an API key and its permissions, which is also an item of DynamoDB
+// Zero quota means unlimited and empty list means everything is allowed
+type Key struct {
+	Key string `toml:"key" json:"key"`
+	// DailyQuota caps the number of requests per UTC day
+	DailyQuota uint64 `toml:"daily_quota" json:"dailyQuota"`
+	// PerSecondQuota caps the number of requests per second
+	PerSecondQuota uint64 `toml:"per_second_quota" json:"perSecondQuota"`
+	// Methods is a list of method names or globs such as "eth_*"
+	Methods []string `toml:"methods" json:"methods"`
+	// Origins is a list of allowed Origin headers, "*" allows any
+	Origins []string `toml:"origins" json:"origins"`
+}
+
+// Limit is settings of rate and concurrency limits in HTTP mode
+// Zero value of Rate or MaxInFlight disables the limit
+type Limit struct {
+	// Rate is tokens refilled per second for each client
+	Rate int `toml:"rate"`
+	// Burst is the capacity of token bucket, zero means Rate
+	Burst int `toml:"burst"`
+	// Weights is tokens taken by a method name or glob, 1 by default
+	Weights map[string]int `toml:"weights"`
+	// MaxInFlight caps requests being processed at once
+	MaxInFlight int `toml:"max_in_flight"`
+	// MaxQueue caps requests waiting for a slot of MaxInFlight
+	MaxQueue int `toml:"max_queue"`
+	// QueueTimeout is milliseconds for a request to wait in queue
+	QueueTimeout int `toml:"queue_timeout"`
+	// TrustedProxies is the number of proxies in front appending to X-Forwarded-For
+	// Zero ignores the header and identifies a client by its remote address
+	TrustedProxies int `toml:"trusted_proxies"`
+}
+
+// IPFS is settings of IPFS nodes
+type IPFS struct {
+	Urls []string `toml:"urls"`
+}
+
+// env is an environment variable overriding a setting
+type env struct {
+	name  string
+	apply func(c *Config, v string) error
+}
+
+// envs are environment variables overriding config file
+// Lists are separated by comma
+var envs = []env{
+	{"NETWORK", func(c *Config, v string) error { c.Network = v; return nil }},
+	{"PORT", func(c *Config, v string) (err error) { c.Port, err = strconv.Atoi(v); return }},
+	{"MAINNET_URLS", func(c *Config, v string) error { c.RPC.MainnetUrls = split(v); return nil }},
+	{"TESTNET_URLS", func(c *Config, v string) error { c.RPC.TestnetUrls = split(v); return nil }},
+	{"MAINNET_WS_URLS", func(c *Config, v string) error { c.RPC.MainnetWsUrls = split(v); return nil }},
+	{"TESTNET_WS_URLS", func(c *Config, v string) error { c.RPC.TestnetWsUrls = split(v); return nil }},
+	{"MAINNET_STRATEGY", func(c *Config, v string) error { c.RPC.MainnetStrategy = v; return nil }},
+	{"TESTNET_STRATEGY", func(c *Config, v string) error { c.RPC.TestnetStrategy = v; return nil }},
+	{"MAINNET_WEIGHTS", func(c *Config, v string) (err error) { c.RPC.MainnetWeights, err = splitInts(v); return }},
+	{"TESTNET_WEIGHTS", func(c *Config, v string) (err error) { c.RPC.TestnetWeights, err = splitInts(v); return }},
+	{"RPC_TIMEOUT", func(c *Config, v string) (err error) { c.RPC.Timeout, err = strconv.Atoi(v); return }},
+	{"RPC_RETRY_COUNT", func(c *Config, v string) (err error) { c.RPC.RetryCount, err = strconv.Atoi(v); return }},
+	{"RPC_RETRY_BACKOFF", func(c *Config, v string) (err error) { c.RPC.RetryBackoff, err = strconv.Atoi(v); return }},
+	{"RPC_FAIL_THRESHOLD", func(c *Config, v string) (err error) { c.RPC.FailThreshold, err = strconv.Atoi(v); return }},
+	{"RPC_COOLDOWN", func(c *Config, v string) (err error) { c.RPC.Cooldown, err = strconv.Atoi(v); return }},
+	{"RPC_MAX_LAG", func(c *Config, v string) (err error) { c.RPC.MaxLag, err = strconv.Atoi(v); return }},
+	{"RPC_HEAD_INTERVAL", func(c *Config, v string) (err error) { c.RPC.HeadInterval, err = strconv.Atoi(v); return }},
+	{"RPC_ARCHIVE_DEPTH", func(c *Config, v string) (err error) { c.RPC.ArchiveDepth, err = strconv.Atoi(v); return }},
+	{"RPC_HEDGE_PERCENTILE", func(c *Config, v string) (err error) { c.RPC.HedgePercentile, err = strconv.ParseFloat(v, 64); return }},
+	{"RPC_QUORUM", func(c *Config, v string) (err error) { c.RPC.Quorum, err = strconv.Atoi(v); return }},
+	{"RPC_QUORUM_METHODS", func(c *Config, v string) error { c.RPC.QuorumMethods = split(v); return nil }},
+	{"CACHE_SIZE", func(c *Config, v string) (err error) { c.Cache.Size, err = strconv.Atoi(v); return }},
+	{"CACHE_CONFIRMATIONS", func(c *Config, v string) (err error) {
+		c.Cache.Confirmations, err = strconv.ParseUint(v, 10, 64)
+		return
+	}},
+	{"CACHE_DB", func(c *Config, v string) (err error) { c.Cache.DB, err = strconv.ParseBool(v); return }},
+	{"API_KEY_DB", func(c *Config, v string) (err error) { c.Auth.DB, err = strconv.ParseBool(v); return }},
+	{"LIMIT_RATE", func(c *Config, v string) (err error) { c.Limit.Rate, err = strconv.Atoi(v); return }},
+	{"LIMIT_BURST", func(c *Config, v string) (err error) { c.Limit.Burst, err = strconv.Atoi(v); return }},
+	{"LIMIT_MAX_IN_FLIGHT", func(c *Config, v string) (err error) { c.Limit.MaxInFlight, err = strconv.Atoi(v); return }},
+	{"LIMIT_TRUSTED_PROXIES", func(c *Config, v string) (err error) { c.Limit.TrustedProxies, err = strconv.Atoi(v); return }},
+	{"IPFS_URLS", func(c *Config, v string) error { c.IPFS.Urls = split(v); return nil }},
+}
+
+// Default returns settings used when neither file nor environment gives them
+func Default() Config {
+	return Config{
+		Network: Testnet,
+		Port:    8545,
+		RPC: RPC{
+			Timeout:       5,
+			RetryCount:    3,
+			RetryBackoff:  100,
+			FailThreshold: 10,
+			Cooldown:      30,
+			MaxLag:        5,
+			HeadInterval:  5,
+			ArchiveDepth:  128,
+			Quorum:        3,
+		},
+		// Head and gas price are cached for a block time at most
+		Cache: Cache{
+			Size: 10000,
+			TTL: map[string]int{
+				"eth_blockNumber": 1000,
+				"eth_gasPrice":    5000,
+			},
+			Confirmations: 64,
+		},
+		// Namespaces which control node or expose accounts are denied
+		Policy: Policy{
+			Default: Allow,
+			Deny:    []string{"personal_*", "admin_*", "debug_*", "miner_*"},
+		},
+		IPFS: IPFS{
+			Urls: []string{"localhost:5001"},
+		},
+	}
+}
+
+// For singleton
+var (
+	instance *Config
+	mu       sync.RWMutex
+	once     sync.Once
+)
+
+// GetInstance returns Config loaded from CONFIG_PATH and environment
+// It panics when the config is invalid not to start with wrong settings
+func GetInstance() *Config {
+	once.Do(func() {
+		cfg, err := Load(os.Getenv(Path))
+		if err != nil {
+			log.Panic("Failed to load config, ", err)
+		}
+		instance = cfg
+	})
+	mu.RLock()
+	defer mu.RUnlock()
+	return instance
+}
+
+// Reload loads Config again and replaces the instance
+// The instance is kept when the new one is invalid
+func Reload() (*Config, error) {
+	cfg, err := Load(os.Getenv(Path))
+	if err != nil {
+		return nil, err
+	}
+	// Loading at first is no longer needed
+	once.Do(func() {})
+	mu.Lock()
+	instance = cfg
+	mu.Unlock()
+	return cfg, nil
+}
+
+// Load returns validated Config from TOML file and environment
+// Default is used as a base and blank filepath means no file
+func Load(filepath string) (*Config, error) {
+	cfg := Default()
+	if filepath != "" {
+		// TTL given by file replaces default one instead of being merged into it
+		cfg.Cache.TTL = nil
+		md, err := toml.DecodeFile(filepath, &cfg)
+		if err != nil {
+			return nil, err
+		}
+		// Reject unknown keys not to ignore a typo silently
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("config: unknown key %s", undecoded[0])
+		}
+		if !md.IsDefined("cache", "ttl") {
+			cfg.Cache.TTL = Default().Cache.TTL
+		}
+	}
+	for _, e := range envs {
+		if v, ok := os.LookupEnv(e.name); ok {
+			if err := e.apply(&cfg, v); err != nil {
+				return nil, fmt.Errorf("config: invalid %s: %s", e.name, err)
+			}
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks if settings are usable
+func (c *Config) Validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("config: invalid port %d", c.Port)
+	}
+	if c.RPC.Timeout <= 0 || c.RPC.RetryCount <= 0 || c.RPC.FailThreshold <= 0 || c.RPC.Cooldown <= 0 {
+		return fmt.Errorf("config: rpc timeout, retry_count, fail_threshold and cooldown must be positive")
+	}
+	if c.RPC.RetryBackoff < 0 || c.RPC.MaxLag < 0 || c.RPC.HeadInterval < 0 || c.RPC.ArchiveDepth < 0 {
+		return fmt.Errorf("config: rpc retry_backoff, max_lag, head_interval and archive_depth must not be negative")
+	}
+	if c.RPC.HedgePercentile < 0 || c.RPC.HedgePercentile >= 100 {
+		return fmt.Errorf("config: rpc hedge_percentile must be in [0, 100)")
+	}
+	if c.RPC.Quorum < 2 {
+		return fmt.Errorf("config: rpc quorum must be at least 2")
+	}
+	for _, m := range c.RPC.QuorumMethods {
+		if _, err := path.Match(m, ""); err != nil {
+			return fmt.Errorf("config: invalid quorum method %q", m)
+		}
+	}
+
+	chains := c.AllChains()
+	if _, ok := chains[c.Network]; !ok {
+		return fmt.Errorf("config: no rpc url for %s, give it by file of %s or MAINNET_URLS and TESTNET_URLS", c.Network, Path)
+	}
+	for name, chain := range chains {
+		if !chainName.MatchString(name) || reservedNames[name] {
+			return fmt.Errorf("config: invalid chain name %q", name)
+		}
+		if len(chain.Urls) == 0 && len(chain.Upstreams) == 0 {
+			return fmt.Errorf("config: no rpc url for %s", name)
+		}
+		for _, u := range chain.Urls {
+			if err := checkURL(u, upstreamSchemes...); err != nil {
+				return err
+			}
+		}
+		for _, u := range chain.Upstreams {
+			if err := u.validate(); err != nil {
+				return fmt.Errorf("config: upstream %s of %s: %s", u, name, err)
+			}
+		}
+		for _, u := range chain.WsUrls {
+			if err := checkURL(u, "ws", "wss"); err != nil {
+				return err
+			}
+		}
+		if chain.Strategy != "" && !strategies[chain.Strategy] {
+			return fmt.Errorf("config: unknown strategy %q of %s", chain.Strategy, name)
+		}
+		if len(chain.Weights) > 0 && len(chain.Weights) != len(chain.Urls) {
+			return fmt.Errorf("config: weights of %s must be given for every url", name)
+		}
+		for _, w := range chain.Weights {
+			if w <= 0 {
+				return fmt.Errorf("config: weights of %s must be positive", name)
+			}
+		}
+	}
+	if c.Cache.Size < 0 {
+		return fmt.Errorf("config: cache size must not be negative")
+	}
+	for method, ttl := range c.Cache.TTL {
+		// Writes are never cached
+		if !ethjson.IsIdempotent(method) || ttl < 0 {
+			return fmt.Errorf("config: invalid cache ttl of %s", method)
+		}
+	}
+	if err := c.Policy.validate(); err != nil {
+		return err
+	}
+	for i, k := range c.Auth.Keys {
+		if k.Key == "" {
+			return fmt.Errorf("config: auth key %d is empty", i)
+		}
+	}
+	if err := c.Limit.validate(); err != nil {
+		return err
+	}
+	if len(c.IPFS.Urls) == 0 {
+		return fmt.Errorf("config: no ipfs url")
+	}
+	return nil
+}
+
+// validate checks actions and patterns of policy
+func (p Policy) validate() error {
+	if p.Default != "" && p.Default != Allow && p.Default != Deny {
+		return fmt.Errorf("config: invalid policy default %q", p.Default)
+	}
+	for _, pattern := range append(append([]string(nil), p.Allow...), p.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("config: invalid policy pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// validate checks limits are not negative
+func (l Limit) validate() error {
+	if l.Rate < 0 || l.Burst < 0 || l.MaxInFlight < 0 || l.MaxQueue < 0 || l.QueueTimeout < 0 || l.TrustedProxies < 0 {
+		return fmt.Errorf("config: limit must not be negative")
+	}
+	for pattern, weight := range l.Weights {
+		if _, err := path.Match(pattern, ""); err != nil || weight < 0 {
+			return fmt.Errorf("config: invalid limit weight %q", pattern)
+		}
+	}
+	return nil
+}
+
+// AllChains returns every chain including mainnet and testnet given by rpc
+// A chain without URL is omitted
+func (c *Config) AllChains() map[string]Chain {
+	chains := make(map[string]Chain, len(c.Chains)+2)
+	if len(c.RPC.MainnetUrls) > 0 || len(c.RPC.MainnetUpstreams) > 0 {
+		chains[Mainnet] = Chain{
+			Urls:      c.RPC.MainnetUrls,
+			WsUrls:    c.RPC.MainnetWsUrls,
+			Strategy:  c.RPC.MainnetStrategy,
+			Weights:   c.RPC.MainnetWeights,
+			Upstreams: c.RPC.MainnetUpstreams,
+		}
+	}
+	if len(c.RPC.TestnetUrls) > 0 || len(c.RPC.TestnetUpstreams) > 0 {
+		chains[Testnet] = Chain{
+			Urls:      c.RPC.TestnetUrls,
+			WsUrls:    c.RPC.TestnetWsUrls,
+			Strategy:  c.RPC.TestnetStrategy,
+			Weights:   c.RPC.TestnetWeights,
+			Upstreams: c.RPC.TestnetUpstreams,
+		}
+	}
+	for name, chain := range c.Chains {
+		chains[name] = chain
+	}
+	return chains
+}
+
+// validate checks if the upstream has credentials its authentication needs
+func (u Upstream) validate() error {
+	// URL is not told not to expose an API key in it
+	if err := checkURL(u.URL, upstreamSchemes...); err != nil {
+		return fmt.Errorf("url must be absolute and one of %s", strings.Join(upstreamSchemes, ", "))
+	}
+	if !auths[u.Auth] {
+		return fmt.Errorf("unknown auth %q", u.Auth)
+	}
+	switch {
+	case u.Auth == AuthBasic && u.Username == "":
+		return fmt.Errorf("basic auth needs username")
+	case u.Auth != "" && u.Auth != AuthBasic && u.Token == "":
+		return fmt.Errorf("%s auth needs token", u.Auth)
+	case u.Auth == AuthJWT && !isHex(u.Token):
+		return fmt.Errorf("jwt secret must be hex")
+	case u.Weight < 0 || u.Timeout < 0:
+		return fmt.Errorf("weight and timeout must not be negative")
+	}
+	return nil
+}
+
+// isHex reports whether s is hex with or without 0x
+func isHex(s string) bool {
+	_, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	return err == nil && s != ""
+}
+
+// checkURL checks if rawurl is absolute and has one of schemes
+// URL of unix socket has path instead of host
+func checkURL(rawurl string, schemes ...string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Host == "" && (u.Scheme != "unix" || u.Path == "")) {
+		return fmt.Errorf("config: invalid url %q", rawurl)
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("config: url %q must be one of %s", rawurl, strings.Join(schemes, ", "))
+}
+
+// splitInts returns comma separated integers
+func splitInts(v string) (ret []int, err error) {
+	for _, item := range split(v) {
+		i, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, i)
+	}
+	return
+}
+
+// split returns comma separated items without blank
+func split(v string) (ret []string) {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return
+}
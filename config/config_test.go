@@ -0,0 +1,241 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+network = "mainnet"
+port = 8080
+
+[rpc]
+mainnet_urls = ["https://mainnet.example"]
+mainnet_ws_urls = ["wss://mainnet.example/ws"]
+timeout = 3
+
+[chains.137]
+chain_id = 137
+urls = ["https://polygon.example"]
+strategy = "least-latency"
+
+[[chains.137.upstreams]]
+url = "https://provider.example/v1/key"
+auth = "bearer"
+token = "secret"
+weight = 2
+archive = true
+headers = { X-Client = "proxy" }
+
+[cache]
+size = 100
+ttl = { eth_gasPrice = 3000 }
+
+[policy]
+allow = ["debug_traceTransaction"]
+constraints = { eth_getLogs = { max_block_range = 100 } }
+
+[[auth.keys]]
+key = "dapp"
+daily_quota = 10
+origins = ["https://dapp.example"]
+
+[limit]
+rate = 10
+weights = { eth_getLogs = 5 }
+trusted_proxies = 1
+
+[ipfs]
+urls = ["ipfs.example:5001"]
+`
+
+func testFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestLoad(t *testing.T) {
+	path := testFile(t, testConfig)
+	defer os.Remove(path)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %s", err)
+	}
+	if cfg.Network != Mainnet || cfg.Port != 8080 || cfg.RPC.Timeout != 3 || cfg.IPFS.Urls[0] != "ipfs.example:5001" {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+	if cfg.RPC.RetryCount != 3 || cfg.RPC.ArchiveDepth != 128 || cfg.Cache.Confirmations != 64 {
+		t.Errorf("Default should be kept unless given: %+v", cfg)
+	}
+	if cfg.Cache.Size != 100 || len(cfg.Cache.TTL) != 1 || cfg.Cache.TTL["eth_gasPrice"] != 3000 || cfg.Cache.DB {
+		t.Errorf("Failed to load cache: %+v", cfg.Cache)
+	}
+	if p := cfg.Policy; p.Default != Allow || len(p.Deny) != 4 || p.Allow[0] != "debug_traceTransaction" || p.Constraints["eth_getLogs"].MaxBlockRange != 100 {
+		t.Errorf("Failed to load policy: %+v", p)
+	}
+	if keys := cfg.Auth.Keys; len(keys) != 1 || keys[0].Key != "dapp" || keys[0].DailyQuota != 10 || keys[0].Origins[0] != "https://dapp.example" {
+		t.Errorf("Failed to load API keys: %+v", keys)
+	}
+	if l := cfg.Limit; l.Rate != 10 || l.Weights["eth_getLogs"] != 5 || l.TrustedProxies != 1 || l.MaxInFlight != 0 {
+		t.Errorf("Failed to load limit: %+v", l)
+	}
+	chains := cfg.AllChains()
+	if len(chains) != 2 || chains[Mainnet].Urls[0] != "https://mainnet.example" || chains[Mainnet].WsUrls[0] != "wss://mainnet.example/ws" {
+		t.Errorf("Mainnet should be a chain: %+v", chains)
+	}
+	if chains["137"].ChainID != 137 || chains["137"].Urls[0] != "https://polygon.example" || chains["137"].Strategy != LeastLatency {
+		t.Errorf("Failed to load chain: %+v", chains)
+	}
+	ups := chains["137"].AllUpstreams()
+	if len(ups) != 2 || ups[0].URL != "https://polygon.example" || ups[1].Auth != AuthBearer || ups[1].Weight != 2 || ups[1].Headers["X-Client"] != "proxy" || ups[0].Archive || !ups[1].Archive {
+		t.Errorf("Failed to load upstreams: %+v", ups)
+	}
+	if s := fmt.Sprintf("%v", ups[1]); strings.Contains(s, "key") || strings.Contains(s, "secret") {
+		t.Errorf("Upstream should be printed without credentials: %s", s)
+	}
+
+	// Environment variables override file
+	os.Setenv("PORT", "9000")
+	os.Setenv("MAINNET_URLS", "https://a.example, https://b.example")
+	os.Setenv("MAINNET_STRATEGY", Weighted)
+	os.Setenv("MAINNET_WEIGHTS", "3, 1")
+	os.Setenv("CACHE_DB", "TRUE")
+	os.Setenv("API_KEY_DB", "TRUE")
+	os.Setenv("LIMIT_RATE", "20")
+	defer os.Unsetenv("CACHE_DB")
+	defer os.Unsetenv("API_KEY_DB")
+	defer os.Unsetenv("LIMIT_RATE")
+	defer os.Unsetenv("PORT")
+	defer os.Unsetenv("MAINNET_URLS")
+	defer os.Unsetenv("MAINNET_STRATEGY")
+	defer os.Unsetenv("MAINNET_WEIGHTS")
+	if cfg, err = Load(path); err != nil {
+		t.Fatalf("Failed to load config: %s", err)
+	}
+	if cfg.Port != 9000 || len(cfg.RPC.MainnetUrls) != 2 || cfg.RPC.MainnetUrls[1] != "https://b.example" {
+		t.Errorf("Environment should override file: %+v", cfg)
+	}
+	if !cfg.Cache.DB || !cfg.Auth.DB || cfg.Limit.Rate != 20 {
+		t.Errorf("Cache, API keys and limit should be given by environment")
+	}
+	if mainnet := cfg.AllChains()[Mainnet]; mainnet.Strategy != Weighted || len(mainnet.Weights) != 2 || mainnet.Weights[0] != 3 {
+		t.Errorf("Strategy should be given to mainnet: %+v", mainnet)
+	}
+
+	os.Setenv("PORT", "http")
+	if _, err = Load(path); err == nil {
+		t.Errorf("Invalid environment should be rejected")
+	}
+
+	if _, err = Load(path + ".missing"); err == nil {
+		t.Errorf("Missing file should be rejected")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Config {
+		cfg := Default()
+		cfg.RPC.TestnetUrls = []string{"https://testnet.example"}
+		return cfg
+	}
+	if cfg := valid(); cfg.Validate() != nil {
+		t.Fatalf("Valid config is rejected")
+	}
+	cfg := valid()
+	cfg.Network = "137"
+	cfg.Chains = map[string]Chain{"137": {Urls: []string{"https://polygon.example"}}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Chain should be default network: %s", err)
+	}
+	cfg.Chains["137"] = Chain{Upstreams: []Upstream{{URL: "https://polygon.example", Auth: AuthJWT, Token: "0x00ff"}}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Chain may have upstreams only: %s", err)
+	}
+	cfg.Chains["137"] = Chain{Urls: []string{"wss://polygon.example/ws", "unix:///var/run/geth.ipc"}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Upstream may be WebSocket or IPC: %s", err)
+	}
+
+	tests := map[string]func(*Config){
+		"network":      func(c *Config) { c.Network = "rinkeby" },
+		"port":         func(c *Config) { c.Port = 0 },
+		"timeout":      func(c *Config) { c.RPC.Timeout = 0 },
+		"cooldown":     func(c *Config) { c.RPC.Cooldown = 0 },
+		"backoff":      func(c *Config) { c.RPC.RetryBackoff = -1 },
+		"max lag":      func(c *Config) { c.RPC.MaxLag = -1 },
+		"archive":      func(c *Config) { c.RPC.ArchiveDepth = -1 },
+		"hedge":        func(c *Config) { c.RPC.HedgePercentile = 100 },
+		"cache size":   func(c *Config) { c.Cache.Size = -1 },
+		"cache ttl":    func(c *Config) { c.Cache.TTL = map[string]int{"eth_sendRawTransaction": 1000} },
+		"quorum":       func(c *Config) { c.RPC.Quorum = 1 },
+		"quorum glob":  func(c *Config) { c.RPC.QuorumMethods = []string{"eth_["} },
+		"no url":       func(c *Config) { c.RPC.TestnetUrls = nil },
+		"other net":    func(c *Config) { c.Network = Mainnet },
+		"scheme":       func(c *Config) { c.RPC.TestnetUrls = []string{"ftp://testnet.example"} },
+		"unix path":    func(c *Config) { c.RPC.TestnetUrls = []string{"unix://"} },
+		"ws scheme":    func(c *Config) { c.RPC.TestnetWsUrls = []string{"https://testnet.example"} },
+		"relative url": func(c *Config) { c.RPC.MainnetUrls = []string{"testnet.example"} },
+		"no ipfs":      func(c *Config) { c.IPFS.Urls = nil },
+		"policy":       func(c *Config) { c.Policy.Default = "maybe" },
+		"policy glob":  func(c *Config) { c.Policy.Allow = []string{"eth_["} },
+		"empty key":    func(c *Config) { c.Auth.Keys = []Key{{DailyQuota: 1}} },
+		"limit":        func(c *Config) { c.Limit.Rate = -1 },
+		"limit weight": func(c *Config) { c.Limit.Weights = map[string]int{"eth_[": 1} },
+		"chain name":   func(c *Config) { c.Chains = map[string]Chain{"a/b": {Urls: []string{"https://a.example"}}} },
+		"reserved":     func(c *Config) { c.Chains = map[string]Chain{"ws": {Urls: []string{"https://a.example"}}} },
+		"chain url":    func(c *Config) { c.Chains = map[string]Chain{"137": {}} },
+		"strategy":     func(c *Config) { c.RPC.TestnetStrategy = "fastest" },
+		"weights":      func(c *Config) { c.RPC.TestnetWeights = []int{1, 2} },
+		"zero weight":  func(c *Config) { c.RPC.TestnetWeights = []int{0} },
+		"upstream url": func(c *Config) { c.RPC.TestnetUpstreams = []Upstream{{URL: "a.example"}} },
+		"auth":         func(c *Config) { c.RPC.TestnetUpstreams = []Upstream{{URL: "https://a.example", Auth: "digest"}} },
+		"username":     func(c *Config) { c.RPC.TestnetUpstreams = []Upstream{{URL: "https://a.example", Auth: AuthBasic}} },
+		"token":        func(c *Config) { c.RPC.TestnetUpstreams = []Upstream{{URL: "https://a.example", Auth: AuthBearer}} },
+		"jwt secret": func(c *Config) {
+			c.RPC.TestnetUpstreams = []Upstream{{URL: "https://a.example", Auth: AuthJWT, Token: "xyz"}}
+		},
+	}
+	for name, modify := range tests {
+		cfg := valid()
+		modify(&cfg)
+		if cfg.Validate() == nil {
+			t.Errorf("Invalid config should be rejected: %s", name)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := testFile(t, testConfig)
+	defer os.Remove(path)
+	os.Setenv(Path, path)
+	defer os.Unsetenv(Path)
+
+	if GetInstance().Port != 8080 {
+		t.Fatalf("Failed to load config from %s", Path)
+	}
+	ioutil.WriteFile(path, []byte(`network = "mainnet"`), 0644)
+	if _, err := Reload(); err == nil || GetInstance().Port != 8080 {
+		t.Errorf("Invalid config should not replace current one")
+	}
+	ioutil.WriteFile(path, []byte(testConfig+"\nport = 8081\n"), 0644)
+	if _, err := Reload(); err == nil {
+		t.Errorf("Unknown key should be rejected")
+	}
+	ioutil.WriteFile(path, []byte(`
+network = "testnet"
+[rpc]
+testnet_urls = ["https://testnet.example"]
+`), 0644)
+	if cfg, err := Reload(); err != nil || GetInstance() != cfg || cfg.Network != Testnet {
+		t.Errorf("Failed to reload config: %v", err)
+	}
+}
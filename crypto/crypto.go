@@ -19,6 +19,7 @@ import (
 	"github.com/hexoul/aws-lambda-eth-proxy/common"
 	"github.com/hexoul/aws-lambda-eth-proxy/db"
 	"github.com/hexoul/aws-lambda-eth-proxy/log"
+	"github.com/hexoul/aws-lambda-eth-proxy/metrics"
 
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	ethcommon "github.com/ethereum/go-ethereum/common"
@@ -49,6 +50,12 @@ var (
 	PassphraseChan = make(chan string)
 )
 
+// For metrics
+var (
+	nonceGauge   = metrics.GetInstance().Gauge("eth_proxy_crypto_nonce", "Nonce to be applied to the next transaction")
+	transactions = metrics.GetInstance().Counter("eth_proxy_crypto_transactions_total", "Transactions applied with nonce by result", "result")
+)
+
 // For DB columns
 const (
 	// DbSecretKeyPropName is DB column name about secret key
@@ -159,6 +166,7 @@ func (c *Crypto) InitChainID(chainID *big.Int) {
 func (c *Crypto) InitNonce(nonce uint64) {
 	if c.txnonce == 0 {
 		c.txnonce = nonce
+		nonceGauge.Set(float64(nonce))
 	}
 }
 
@@ -195,7 +203,12 @@ func (c *Crypto) SignTx(tx *types.Transaction) (*types.Transaction, error) {
 	} else {
 		c.signer = types.HomesteadSigner{}
 	}
-	signedTx, err := types.SignTx(tx, c.signer, c.privKey)
+	return c.SignTxWith(tx, c.signer)
+}
+
+// SignTxWith returns transaction signed by signer of a chain using own private key
+func (c *Crypto) SignTxWith(tx *types.Transaction, signer types.Signer) (*types.Transaction, error) {
+	signedTx, err := types.SignTx(tx, signer, c.privKey)
 	if err != nil {
 		return nil, fmt.Errorf("tx or private key is not appropriate")
 	}
@@ -214,9 +227,11 @@ func (c *Crypto) ApplyNonce(f interface{}) bool {
 	log.Infof("Apply nonce %d to func given", nonce)
 	err := f.(func(uint64) error)(nonce)
 	if err != nil {
+		transactions.Inc("failed")
 		return false
 	}
-	atomic.AddUint64(&c.txnonce, 1)
+	transactions.Inc("applied")
+	nonceGauge.Set(float64(atomic.AddUint64(&c.txnonce, 1)))
 	log.Info("Nonce was increased by one")
 	return true
 }
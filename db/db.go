@@ -3,6 +3,7 @@ package db
 
 import (
 	"os"
+	"strconv"
 	"sync"
 
 	"github.com/hexoul/aws-lambda-eth-proxy/log"
@@ -122,6 +123,70 @@ func (d *DynamoDBHelper) GetItem(tblName, propName, propVal, targetName string)
 	return result
 }
 
+// GetItemByKey returns an item whose partition key named keyName is keyVal
+// Unlike GetItem, it reads a single item without scanning the table
+// It returns nil without error when the item does not exist
+func (d *DynamoDBHelper) GetItemByKey(tblName, keyName, keyVal string) (map[string]*dynamodb.AttributeValue, error) {
+	result, err := d.client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tblName),
+		Key: map[string]*dynamodb.AttributeValue{
+			keyName: {
+				S: aws.String(keyVal),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Item, nil
+}
+
+// AddCounter atomically adds n to number attribute named counterName of an item
+// and returns the updated value. The item is created when it does not exist.
+// expireAt is stored in attribute named ttlName as unix time
+// so that DynamoDB TTL removes stale counters
+func (d *DynamoDBHelper) AddCounter(tblName, keyName, keyVal, counterName string, n int64, ttlName string, expireAt int64) (int64, error) {
+	result, err := d.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(tblName),
+		Key: map[string]*dynamodb.AttributeValue{
+			keyName: {
+				S: aws.String(keyVal),
+			},
+		},
+		UpdateExpression: aws.String("ADD #c :n SET #t = :t"),
+		ExpressionAttributeNames: map[string]*string{
+			"#c": aws.String(counterName),
+			"#t": aws.String(ttlName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":n": {N: aws.String(strconv.FormatInt(n, 10))},
+			":t": {N: aws.String(strconv.FormatInt(expireAt, 10))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, err
+	}
+	attr := result.Attributes[counterName]
+	if attr == nil || attr.N == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(*attr.N, 10, 64)
+}
+
+// PutItem creates or replaces an item marshalled from in
+func (d *DynamoDBHelper) PutItem(tblName string, in interface{}) error {
+	item, err := dynamodbattribute.MarshalMap(in)
+	if err != nil {
+		return err
+	}
+	_, err = d.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(tblName),
+		Item:      item,
+	})
+	return err
+}
+
 // UnmarshalMap makes output data from DynamoDB output
 func (d *DynamoDBHelper) UnmarshalMap(in map[string]*dynamodb.AttributeValue, out interface{}) {
 	if in == nil {
@@ -0,0 +1,159 @@
+// Package health reports state of Ether nodes for probes of load balancer
+//
+// Health is ok when every chain has a node reachable and not syncing.
+// Readiness additionally requires chain ID of every chain to be resolved
+// and crypto key to be loaded when it is given.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/crypto"
+	"github.com/hexoul/aws-lambda-eth-proxy/rpc"
+)
+
+const (
+	// Lifetime of a report not to probe nodes for every request of load balancer
+	reportTTL = 5 * time.Second
+	// Time to wait for nodes to respond
+	probeTimeout = 3 * time.Second
+)
+
+// Report is a state of the proxy
+type Report struct {
+	OK     bool             `json:"ok"`
+	Chains map[string]Chain `json:"chains"`
+	// KeyLoaded is given for readiness when crypto key is required
+	KeyLoaded *bool `json:"keyLoaded,omitempty"`
+}
+
+// Chain is a state of a chain and its nodes
+type Chain struct {
+	OK bool `json:"ok"`
+	// ChainID is blank when it was not resolved
+	ChainID string           `json:"chainId"`
+	Nodes   []rpc.NodeStatus `json:"nodes"`
+}
+
+// Checker probes nodes and keeps the report for a while
+type Checker struct {
+	requireKey bool
+	now        func() time.Time
+
+	mu       sync.Mutex
+	chains   map[string]Chain
+	probedAt time.Time
+}
+
+// New returns Checker
+// requireKey means crypto key is given and readiness waits for it
+func New(requireKey bool) *Checker {
+	return &Checker{
+		requireKey: requireKey,
+		now:        time.Now,
+	}
+}
+
+// Health returns a report whose OK means every chain has a healthy node
+func (c *Checker) Health(ctx context.Context) Report {
+	chains := c.probe(ctx)
+	report := Report{OK: len(chains) > 0, Chains: chains}
+	for _, chain := range chains {
+		report.OK = report.OK && chain.OK
+	}
+	return report
+}
+
+// Ready returns a report whose OK means the proxy can serve every chain
+func (c *Checker) Ready(ctx context.Context) Report {
+	report := c.Health(ctx)
+	for _, chain := range report.Chains {
+		report.OK = report.OK && chain.ChainID != ""
+	}
+	if c.requireKey {
+		loaded := crypto.GetInstance() != nil
+		report.KeyLoaded = &loaded
+		report.OK = report.OK && loaded
+	}
+	return report
+}
+
+// probe returns states of registered chains, probing nodes when the last report is stale
+func (c *Checker) probe(ctx context.Context) map[string]Chain {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.chains != nil && c.now().Sub(c.probedAt) < reportTTL {
+		return c.chains
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	names := rpc.Chains()
+	sort.Strings(names)
+	chains := make(map[string]Chain, len(names))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range names {
+		r := rpc.Get(name)
+		if r == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, r *rpc.RPC) {
+			defer wg.Done()
+			chain := Chain{Nodes: r.CheckNodes(ctx)}
+			if r.NetVersion != nil {
+				chain.ChainID = r.NetVersion.String()
+			}
+			for _, n := range chain.Nodes {
+				chain.OK = chain.OK || n.Healthy()
+			}
+			mu.Lock()
+			chains[name] = chain
+			mu.Unlock()
+		}(name, r)
+	}
+	wg.Wait()
+
+	c.chains, c.probedAt = chains, c.now()
+	return chains
+}
+
+// HealthHandler serves Health with 200, or 503 when it is not ok
+func (c *Checker) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write(w, c.Health(r.Context()))
+	})
+}
+
+// ReadyHandler serves Ready with 200, or 503 when it is not ok
+func (c *Checker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write(w, c.Ready(r.Context()))
+	})
+}
+
+// StatusCode returns HTTP status code of the report
+func (r Report) StatusCode() int {
+	if r.OK {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+// String returns the report in JSON
+func (r Report) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+func write(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(report.StatusCode())
+	w.Write([]byte(report.String()))
+}
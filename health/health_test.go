@@ -0,0 +1,84 @@
+package health
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	"github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/rpc"
+)
+
+// testNode imitates ethereum node having results following method
+func testNode(results map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		req, _ := json.GetRPCRequestFromJSON(string(b))
+		w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":` + results[req.Method] + `}`))
+	}))
+}
+
+func TestCheck(t *testing.T) {
+	synced := testNode(map[string]string{"eth_syncing": "false", "eth_blockNumber": `"0x10"`, "net_version": `"5"`})
+	defer synced.Close()
+	syncing := testNode(map[string]string{"eth_syncing": `{"currentBlock":"0x8"}`, "eth_blockNumber": `"0x8"`, "net_version": `"5"`})
+	defer syncing.Close()
+	down := testNode(nil)
+	down.Close()
+
+	settings := config.Default().RPC
+	settings.RetryCount = 1
+	rpc.Configure(map[string]config.Chain{
+		"a": {ChainID: 5, Urls: []string{synced.URL, syncing.URL, down.URL}},
+		"b": {ChainID: 5, Urls: []string{syncing.URL}},
+	}, settings)
+
+	now := time.Unix(1500000000, 0)
+	c := New(false)
+	c.now = func() time.Time { return now }
+	report := c.Health(context.Background())
+	if report.OK || !report.Chains["a"].OK || report.Chains["b"].OK {
+		t.Fatalf("Chain without healthy node should fail: %s", report)
+	}
+	nodes := report.Chains["a"].Nodes
+	if !nodes[0].Healthy() || nodes[0].BlockNumber != 16 || nodes[0].Lag != 0 {
+		t.Errorf("Unexpected synced node: %+v", nodes[0])
+	}
+	if !nodes[1].Syncing || nodes[1].Healthy() || nodes[1].Lag != 8 {
+		t.Errorf("Unexpected syncing node: %+v", nodes[1])
+	}
+	if nodes[2].Reachable || nodes[2].Error == "" {
+		t.Errorf("Unexpected down node: %+v", nodes[2])
+	}
+	if report.StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("Unhealthy report should be 503")
+	}
+
+	// Report is kept for a while
+	rpc.Configure(map[string]config.Chain{"a": {ChainID: 5, Urls: []string{synced.URL}}}, settings)
+	if report = c.Health(context.Background()); report.OK {
+		t.Errorf("Report should be kept")
+	}
+	now = now.Add(reportTTL)
+	if report = c.Health(context.Background()); !report.OK || report.StatusCode() != http.StatusOK {
+		t.Errorf("Report should be refreshed: %s", report)
+	}
+
+	if report = c.Ready(context.Background()); !report.OK || report.Chains["a"].ChainID != "5" {
+		t.Errorf("Chain should be ready: %s", report)
+	}
+	c.requireKey = true
+	if report = c.Ready(context.Background()); report.OK || report.KeyLoaded == nil || *report.KeyLoaded {
+		t.Errorf("Proxy without crypto key should not be ready: %s", report)
+	}
+
+	w := httptest.NewRecorder()
+	c.ReadyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status %d", w.Code)
+	}
+}
@@ -24,17 +24,39 @@ type Ipfs struct {
 var instance *Ipfs
 var once sync.Once
 
+// mu guards instance and ipfsUrls replaced by Configure
+var mu sync.RWMutex
+
 // GetInstance returns an instance of Ipfs
 func GetInstance() *Ipfs {
 	once.Do(func() {
-		ns := shell.NewShell(ipfsUrls[rand.Intn(len(ipfsUrls))])
-		instance = &Ipfs{
-			s: ns,
-		}
+		mu.Lock()
+		instance = newIpfs()
+		mu.Unlock()
 	})
+	mu.RLock()
+	defer mu.RUnlock()
 	return instance
 }
 
+// Configure replaces IPFS node URLs
+// The instance is renewed with a node among them while the old one still works
+func Configure(urls []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	ipfsUrls = append([]string(nil), urls...)
+	if instance != nil {
+		instance = newIpfs()
+	}
+}
+
+func newIpfs() *Ipfs {
+	ns := shell.NewShell(ipfsUrls[rand.Intn(len(ipfsUrls))])
+	return &Ipfs{
+		s: ns,
+	}
+}
+
 // Cat returns data from IPFS with path(file hash)
 func (ipfs *Ipfs) Cat(path string) (ret string) {
 	rc, err := ipfs.s.Cat(path)
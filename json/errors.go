@@ -0,0 +1,155 @@
+package json
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Standard error codes defined by JSON-RPC 2.0
+const (
+	// ParseErrorCode means invalid JSON was received
+	ParseErrorCode = -32700
+	// InvalidRequestCode means the JSON sent is not a valid request object
+	InvalidRequestCode = -32600
+	// MethodNotFoundCode means the method does not exist or is not available
+	MethodNotFoundCode = -32601
+	// InvalidParamsCode means invalid method parameters
+	InvalidParamsCode = -32602
+	// InternalErrorCode means internal JSON-RPC error
+	InternalErrorCode = -32603
+)
+
+// Error codes defined by EIP-1474
+const (
+	// MethodNotSupportedCode means the method is not served by this proxy
+	MethodNotSupportedCode = -32004
+	// LimitExceededCode means request exceeds defined limit
+	LimitExceededCode = -32005
+)
+
+// Proxy-specific error codes within server error range, -32000 to -32099
+const (
+	// UpstreamTimeoutCode means ethereum node did not respond in time
+	UpstreamTimeoutCode = -32090
+	// UpstreamUnavailableCode means ethereum node is not reachable
+	UpstreamUnavailableCode = -32091
+	// UnauthorizedCode means API key is missing or invalid
+	UnauthorizedCode = -32092
+	// ForbiddenCode means API key is not allowed to make the request
+	ForbiddenCode = -32093
+	// RateLimitedCode means client exceeds its quota or rate limit
+	RateLimitedCode = -32094
+	// QuorumNotReachedCode means ethereum nodes did not agree on a result
+	QuorumNotReachedCode = -32095
+)
+
+var errorMessages = map[int32]string{
+	ParseErrorCode:          "Parse error",
+	InvalidRequestCode:      "Invalid Request",
+	MethodNotFoundCode:      "Method not found",
+	InvalidParamsCode:       "Invalid params",
+	InternalErrorCode:       "Internal error",
+	MethodNotSupportedCode:  "Method not supported",
+	LimitExceededCode:       "Limit exceeded",
+	UpstreamTimeoutCode:     "Upstream timeout",
+	UpstreamUnavailableCode: "Upstream unavailable",
+	UnauthorizedCode:        "Unauthorized",
+	ForbiddenCode:           "Forbidden",
+	RateLimitedCode:         "Too many requests",
+	QuorumNotReachedCode:    "Quorum not reached",
+}
+
+// errorStatuses maps error code to HTTP status code
+// Like geth, errors carried in JSON-RPC body are served with 200 OK
+// while malformed requests and upstream failures follow common providers
+var errorStatuses = map[int32]int{
+	ParseErrorCode:          http.StatusBadRequest,
+	InvalidRequestCode:      http.StatusBadRequest,
+	UpstreamTimeoutCode:     http.StatusGatewayTimeout,
+	UpstreamUnavailableCode: http.StatusBadGateway,
+	UnauthorizedCode:        http.StatusUnauthorized,
+	ForbiddenCode:           http.StatusForbidden,
+	RateLimitedCode:         http.StatusTooManyRequests,
+	QuorumNotReachedCode:    http.StatusBadGateway,
+}
+
+// NewRPCError returns RPCError having standard message of given code
+// data is optional and may be nil
+func NewRPCError(code int32, data interface{}) *RPCError {
+	return &RPCError{
+		Code:    code,
+		Message: errorMessages[code],
+		Data:    data,
+	}
+}
+
+// NewParseError returns RPCError about invalid JSON
+func NewParseError(data interface{}) *RPCError {
+	return NewRPCError(ParseErrorCode, data)
+}
+
+// NewInvalidRequest returns RPCError about invalid request object
+func NewInvalidRequest(data interface{}) *RPCError {
+	return NewRPCError(InvalidRequestCode, data)
+}
+
+// NewMethodNotFound returns RPCError about unknown method
+func NewMethodNotFound(method string) *RPCError {
+	return &RPCError{
+		Code:    MethodNotFoundCode,
+		Message: fmt.Sprintf("the method %s does not exist/is not available", method),
+	}
+}
+
+// NewInvalidParams returns RPCError about invalid parameters
+func NewInvalidParams(data interface{}) *RPCError {
+	return NewRPCError(InvalidParamsCode, data)
+}
+
+// NewInternalError returns RPCError about internal failure
+func NewInternalError(data interface{}) *RPCError {
+	return NewRPCError(InternalErrorCode, data)
+}
+
+// NewRateLimited returns RPCError asking client to retry after given seconds
+func NewRateLimited(data interface{}, retryAfter int) *RPCError {
+	e := NewRPCError(RateLimitedCode, data)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+// NewUpstreamError classifies an error occurred while relaying to ethereum node
+func NewUpstreamError(err error) *RPCError {
+	if e, ok := err.(*RPCError); ok {
+		return e
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return NewRPCError(UpstreamTimeoutCode, err.Error())
+	}
+	return NewRPCError(UpstreamUnavailableCode, err.Error())
+}
+
+// ToRPCError converts general error to RPCError
+// Unclassified error is regarded as internal error
+func ToRPCError(err error) *RPCError {
+	if e, ok := err.(*RPCError); ok {
+		return e
+	}
+	return NewInternalError(err.Error())
+}
+
+func (e *RPCError) Error() string {
+	if e.Data != nil {
+		return fmt.Sprintf("%s (%d): %v", e.Message, e.Code, e.Data)
+	}
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// HTTPStatus returns HTTP status code matched with error code
+func (e *RPCError) HTTPStatus() int {
+	if status, ok := errorStatuses[e.Code]; ok {
+		return status
+	}
+	return http.StatusOK
+}
@@ -2,36 +2,112 @@
 package json
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"strings"
 )
 
+// Version is the only JSON-RPC version supported
+const Version = "2.0"
+
 // RPCRequest is a interface for JSON-RPC request
+// ID is kept as raw JSON to be relayed unchanged, nil means notification
 type RPCRequest struct {
-	Jsonrpc string        `json:"jsonrpc"`
-	Method  string        `json:"method"`
-	Params  []interface{} `json:"params"`
-	ID      int32         `json:"id"`
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  []interface{}   `json:"params"`
+	ID      json.RawMessage `json:"id,omitempty"`
 }
 
 // RPCError is a interface for JSON-RPC error
 type RPCError struct {
-	Code    int32  `json:"code,omitempty"`
-	Message string `json:"message,omitempty"`
+	Code    int32       `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+	// RetryAfter is seconds to wait before retrying, served as Retry-After header
+	RetryAfter int `json:"-"`
 }
 
 // RPCResponse is a interface for JSON-RPC response
 type RPCResponse struct {
-	Jsonrpc string      `json:"jsonrpc"`
-	ID      int32       `json:"id"`
-	Result  interface{} `json:"result,omitempty"`
-	Error   *RPCError   `json:"error,omitempty"`
+	Jsonrpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
 }
 
 // GetRPCRequestFromJSON returns RPCRequest struct from JSON
-func GetRPCRequestFromJSON(msg string) RPCRequest {
-	var data RPCRequest
-	json.Unmarshal([]byte(msg), &data)
-	return data
+// RPCError is returned when msg is not a valid JSON-RPC request
+func GetRPCRequestFromJSON(msg string) (data RPCRequest, rpcErr *RPCError) {
+	return parseRPCRequest([]byte(msg))
+}
+
+// GetRPCRequestsFromJSON returns RPCRequest list from JSON
+// isBatch reports whether msg is a JSON-RPC batch, an array of requests
+// errs has the same length with reqs and indicates an invalid element
+func GetRPCRequestsFromJSON(msg string) (reqs []RPCRequest, errs []*RPCError, isBatch bool) {
+	trimmed := strings.TrimSpace(msg)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		req, err := parseRPCRequest([]byte(msg))
+		return []RPCRequest{req}, []*RPCError{err}, false
+	}
+
+	var raws []json.RawMessage
+	if err := json.Unmarshal([]byte(trimmed), &raws); err != nil {
+		return []RPCRequest{{}}, []*RPCError{NewParseError(err.Error())}, false
+	}
+	reqs = make([]RPCRequest, len(raws))
+	errs = make([]*RPCError, len(raws))
+	for i, raw := range raws {
+		reqs[i], errs[i] = parseRPCRequest(raw)
+	}
+	return reqs, errs, true
+}
+
+// parseRPCRequest unmarshals and validates a single request object
+func parseRPCRequest(msg []byte) (data RPCRequest, rpcErr *RPCError) {
+	if err := json.Unmarshal(msg, &data); err != nil {
+		if !json.Valid(msg) {
+			return data, NewParseError(err.Error())
+		}
+		return data, NewInvalidRequest(err.Error())
+	}
+	return data, data.Validate()
+}
+
+// Validate checks version, id and method of the request
+// Invalid id is cleared so that the error is replied with null id
+func (req *RPCRequest) Validate() *RPCError {
+	if req.Jsonrpc != Version {
+		return NewInvalidRequest("jsonrpc must be " + Version)
+	}
+	if !validID(req.ID) {
+		req.ID = nil
+		return NewInvalidRequest("id must be string, number or null")
+	}
+	if req.Method == "" {
+		return NewInvalidRequest("method is missing")
+	}
+	return nil
+}
+
+// validID checks if id is either absent, string, number or null
+func validID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+// IsNotification reports whether the request has no id member
+// Server must not reply to a notification
+func (r *RPCRequest) IsNotification() bool {
+	return r.ID == nil
 }
 
 func (r *RPCRequest) String() string {
@@ -42,6 +118,13 @@ func (r *RPCRequest) String() string {
 	return ""
 }
 
+// Canonical returns method and params of the request regardless of its id
+// Params are marshalled again, which sorts object keys and drops spaces
+func (r *RPCRequest) Canonical() string {
+	params, _ := json.Marshal(r.Params)
+	return r.Method + string(params)
+}
+
 // GetRPCResponseFromJSON returns RPCRequest struct from JSON
 func GetRPCResponseFromJSON(msg string) RPCResponse {
 	var data RPCResponse
@@ -56,3 +139,75 @@ func (r *RPCResponse) String() string {
 	}
 	return ""
 }
+
+// ReplaceID rewrites id member of JSON-RPC response object with given id
+// Every byte except id is kept as it is to relay a response from node exactly
+func ReplaceID(msg []byte, id json.RawMessage) ([]byte, error) {
+	if id == nil {
+		id = []byte("null")
+	}
+
+	start, end, members, err := findID(msg)
+	if err != nil {
+		return nil, err
+	}
+	if start >= 0 {
+		if bytes.Equal(msg[start:end], id) {
+			return msg, nil
+		}
+		ret := make([]byte, 0, len(msg)-(end-start)+len(id))
+		ret = append(ret, msg[:start]...)
+		ret = append(ret, id...)
+		return append(ret, msg[end:]...), nil
+	}
+
+	// Insert id when the node omits it
+	open := bytes.IndexByte(msg, '{') + 1
+	ret := make([]byte, 0, len(msg)+len(id)+6)
+	ret = append(ret, msg[:open]...)
+	ret = append(ret, `"id":`...)
+	ret = append(ret, id...)
+	if members > 0 {
+		ret = append(ret, ',')
+	}
+	return append(ret, msg[open:]...), nil
+}
+
+// FindID returns offsets of id value in JSON-RPC message object, which is msg[start:end]
+// start is -1 when the object has no id
+func FindID(msg []byte) (start, end int, err error) {
+	start, end, _, err = findID(msg)
+	return
+}
+
+// findID returns offsets of id value and the number of members of the object
+// start is -1 when the object has no id
+func findID(msg []byte) (start, end, members int, err error) {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return -1, -1, 0, fmt.Errorf("message is not JSON object")
+	}
+	for ; dec.More(); members++ {
+		tok, err := dec.Token()
+		if err != nil {
+			return -1, -1, 0, err
+		}
+		var val json.RawMessage
+		if err = dec.Decode(&val); err != nil {
+			return -1, -1, 0, err
+		}
+		if key, _ := tok.(string); key == "id" {
+			// Decoded value is always the exact bytes in front of the offset
+			end = int(dec.InputOffset())
+			return end - len(val), end, members + 1, nil
+		}
+	}
+	return -1, -1, members, nil
+}
+
+// JoinBatch returns JSON array of raw responses without re-encoding them
+func JoinBatch(resps [][]byte) []byte {
+	ret := []byte{'['}
+	ret = append(ret, bytes.Join(resps, []byte{','})...)
+	return append(ret, ']')
+}
@@ -0,0 +1,114 @@
+package json
+
+import (
+	"path"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// nonIdempotent is a list of method names or globs
+// whose call changes state of node or returns a distinct result every time
+var nonIdempotent = []string{
+	"eth_sendRawTransaction",
+	"eth_sendTransaction",
+	"eth_sign",
+	"eth_signTransaction",
+	"eth_submitWork",
+	"eth_submitHashrate",
+	"eth_newFilter",
+	"eth_newBlockFilter",
+	"eth_newPendingTransactionFilter",
+	"eth_uninstallFilter",
+	"eth_getFilterChanges",
+	"eth_subscribe",
+	"eth_unsubscribe",
+	"personal_*",
+	"admin_*",
+	"miner_*",
+}
+
+// IsIdempotent reports whether calling the method twice has the same effect as once
+// so that its calls may be shared, cached or repeated
+func IsIdempotent(method string) bool {
+	for _, pattern := range nonIdempotent {
+		if matched, _ := path.Match(pattern, method); matched {
+			return false
+		}
+	}
+	return true
+}
+
+// blockParams is method name => index of param giving block number or tag
+var blockParams = map[string]int{
+	"eth_getBalance":                          1,
+	"eth_getCode":                             1,
+	"eth_getTransactionCount":                 1,
+	"eth_getStorageAt":                        2,
+	"eth_call":                                1,
+	"eth_estimateGas":                         1,
+	"eth_getProof":                            2,
+	"eth_feeHistory":                          1,
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_getUncleByBlockNumberAndIndex":       0,
+	"eth_getUncleCountByBlockNumber":          0,
+}
+
+// BlockNumber returns the block number which the request names explicitly
+// Tags such as "latest" and omitted blocks are not explicit.
+// For eth_getLogs, the higher of fromBlock and toBlock is returned.
+func BlockNumber(req RPCRequest) (uint64, bool) {
+	if req.Method == "eth_getLogs" {
+		if len(req.Params) == 0 {
+			return 0, false
+		}
+		filter, _ := req.Params[0].(map[string]interface{})
+		from, okFrom := blockNumber(filter["fromBlock"])
+		to, okTo := blockNumber(filter["toBlock"])
+		if to < from {
+			to = from
+		}
+		return to, okFrom || okTo
+	}
+	i, ok := blockParams[req.Method]
+	if !ok || i >= len(req.Params) {
+		return 0, false
+	}
+	return blockNumber(req.Params[i])
+}
+
+// stateMethods are methods reading state of accounts at the block of blockParams
+var stateMethods = map[string]bool{
+	"eth_getBalance":          true,
+	"eth_getCode":             true,
+	"eth_getTransactionCount": true,
+	"eth_getStorageAt":        true,
+	"eth_call":                true,
+	"eth_estimateGas":         true,
+	"eth_getProof":            true,
+}
+
+// StateBlock returns the block whose state the request reads when it is given by number
+// Tag "earliest" is the genesis block, and other tags are not historical.
+func StateBlock(req RPCRequest) (uint64, bool) {
+	i, ok := blockParams[req.Method]
+	if !stateMethods[req.Method] || !ok || i >= len(req.Params) {
+		return 0, false
+	}
+	if tag, _ := req.Params[i].(string); tag == "earliest" {
+		return 0, true
+	}
+	return blockNumber(req.Params[i])
+}
+
+// blockNumber decodes block number given as a quantity
+// or as an object having blockNumber by EIP-1898
+func blockNumber(block interface{}) (uint64, bool) {
+	if obj, ok := block.(map[string]interface{}); ok {
+		block = obj["blockNumber"]
+	}
+	s, _ := block.(string)
+	number, err := hexutil.DecodeUint64(s)
+	return number, err == nil
+}
@@ -0,0 +1,292 @@
+// Package limiter protects Ether nodes from clients flooding requests
+//
+// Each client, identified by API key or IP, has a token bucket
+// refilled at a constant rate and a request takes tokens of its method weight.
+// In-flight requests are also capped globally, and requests over the cap
+// wait in a bounded queue before being rejected.
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+)
+
+const (
+	// Interval to remove buckets of idle clients
+	sweepInterval = time.Minute
+	// Specificity of a pattern without any glob
+	exact = 1 << 16
+)
+
+// Limiter limits request rate per client and in-flight requests
+type Limiter struct {
+	cfg config.Limit
+	now func() time.Time
+	// rate and burst of cfg in tokens
+	rate, burst float64
+	// globs are patterns of Weights ordered from the most specific
+	globs []string
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	slots   chan struct{}
+	waiting int32
+}
+
+// bucket is a token bucket of a client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ctxKey is a context key for client ID
+type ctxKey struct{}
+
+// For singleton
+var (
+	instance *Limiter
+	once     sync.Once
+	// mu guards instance replaced by Configure
+	mu sync.RWMutex
+)
+
+// GetInstance returns Limiter of limit config, or default settings limiting nothing before Configure
+func GetInstance() *Limiter {
+	once.Do(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if instance != nil {
+			return
+		}
+		var err error
+		if instance, err = New(config.Default().Limit); err != nil {
+			log.Panic("Failed to load limiter, ", err)
+		}
+	})
+	mu.RLock()
+	defer mu.RUnlock()
+	return instance
+}
+
+// Configure replaces limits keeping token buckets of clients
+// Requests in flight hold slots of the old instance until they are done
+// The instance is kept when the new one cannot be made
+func Configure(cfg config.Limit) {
+	l, err := New(cfg)
+	if err != nil {
+		log.Error("Failed to configure limiter, ", err)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		instance.mu.Lock()
+		for client, b := range instance.buckets {
+			l.buckets[client] = &bucket{tokens: math.Min(b.tokens, l.burst), last: b.last}
+		}
+		instance.mu.Unlock()
+	}
+	instance = l
+}
+
+// New validates config and returns Limiter
+func New(cfg config.Limit) (*Limiter, error) {
+	if cfg.Rate < 0 || cfg.Burst < 0 || cfg.MaxInFlight < 0 || cfg.MaxQueue < 0 || cfg.QueueTimeout < 0 || cfg.TrustedProxies < 0 {
+		return nil, fmt.Errorf("limiter: negative limit")
+	}
+	if cfg.Burst == 0 {
+		cfg.Burst = cfg.Rate
+	}
+	for pattern, weight := range cfg.Weights {
+		if _, err := path.Match(pattern, ""); err != nil || weight < 0 {
+			return nil, fmt.Errorf("limiter: invalid weight %q: %v", pattern, weight)
+		}
+	}
+
+	l := &Limiter{
+		cfg:     cfg,
+		now:     time.Now,
+		rate:    float64(cfg.Rate),
+		burst:   float64(cfg.Burst),
+		buckets: make(map[string]*bucket),
+	}
+	for pattern := range cfg.Weights {
+		if specificity(pattern) < exact {
+			l.globs = append(l.globs, pattern)
+		}
+	}
+	sort.Slice(l.globs, func(i, j int) bool {
+		a, b := l.globs[i], l.globs[j]
+		if sa, sb := specificity(a), specificity(b); sa != sb {
+			return sa > sb
+		}
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	if cfg.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, cfg.MaxInFlight)
+	}
+	return l, nil
+}
+
+// Client returns IP of the client sending r
+// It is taken from X-Forwarded-For as appended by the last trusted proxy,
+// so that addresses forged by the client in front of it are ignored
+func (l *Limiter) Client(r *http.Request) string {
+	client := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client = host
+	}
+	if l.cfg.TrustedProxies == 0 {
+		return client
+	}
+	var addrs []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return client
+	}
+	if i := len(addrs) - l.cfg.TrustedProxies; i > 0 {
+		return addrs[i]
+	}
+	return addrs[0]
+}
+
+// Weight returns tokens taken by the method
+// Exact name is preferred to glob, and among globs the longest literal prefix wins
+func (l *Limiter) Weight(method string) float64 {
+	if w, ok := l.cfg.Weights[method]; ok {
+		return float64(w)
+	}
+	for _, pattern := range l.globs {
+		if matched, _ := path.Match(pattern, method); matched {
+			return float64(l.cfg.Weights[pattern])
+		}
+	}
+	return 1
+}
+
+// specificity scores exact name over any glob, longer literal prefix first, as policy does
+func specificity(pattern string) int {
+	if i := strings.IndexAny(pattern, "*?["); i >= 0 {
+		return i
+	}
+	return exact
+}
+
+// Take takes tokens from the bucket of client
+// RPCError having seconds to retry is returned when tokens are not enough
+// Weight over the burst requires a full bucket not to be rejected forever
+func (l *Limiter) Take(client string, weight float64) *ethjson.RPCError {
+	if l.rate == 0 || weight == 0 {
+		return nil
+	}
+	if weight > l.burst {
+		weight = l.burst
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b := l.buckets[client]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < weight {
+		wait := math.Ceil((weight - b.tokens) / l.rate)
+		return ethjson.NewRateLimited("rate limit exceeded", int(wait))
+	}
+	b.tokens -= weight
+	return nil
+}
+
+// sweep removes buckets which would be full by now
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Acquire waits for a slot of in-flight requests
+// release must be called when the request is done
+// RPCError is returned when the queue is full or the wait times out
+func (l *Limiter) Acquire(ctx context.Context) (release func(), rpcErr *ethjson.RPCError) {
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	// Backpressure: wait in bounded queue
+	if int(atomic.AddInt32(&l.waiting, 1)) > l.cfg.MaxQueue {
+		atomic.AddInt32(&l.waiting, -1)
+		return nil, ethjson.NewRateLimited("server is busy", 1)
+	}
+	defer atomic.AddInt32(&l.waiting, -1)
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timer := time.NewTimer(time.Duration(l.cfg.QueueTimeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ethjson.NewRateLimited("server is busy", 1)
+	case <-ctx.Done():
+		return nil, ethjson.NewRateLimited(ctx.Err().Error(), 1)
+	}
+}
+
+// NewContext returns context carrying client ID to be rate limited
+func NewContext(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, client)
+}
+
+// FromContext returns client ID carried by context, or blank if there is none
+func FromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	client, _ := ctx.Value(ctxKey{}).(string)
+	return client
+}
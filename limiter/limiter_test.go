@@ -0,0 +1,211 @@
+package limiter
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	"github.com/hexoul/aws-lambda-eth-proxy/json"
+)
+
+// testConfig makes heavy methods cost more than a simple query
+var testConfig = config.Limit{
+	Rate:  50,
+	Burst: 100,
+	Weights: map[string]int{
+		"eth_getLogs":     10,
+		"eth_call":        2,
+		"eth_estimateGas": 2,
+		"debug_*":         20,
+		"trace_*":         20,
+	},
+	MaxInFlight:  256,
+	MaxQueue:     1024,
+	QueueTimeout: 5000,
+}
+
+func TestWeight(t *testing.T) {
+	l, err := New(testConfig)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tests := map[string]float64{
+		"eth_getLogs":            10,
+		"eth_blockNumber":        1,
+		"debug_traceTransaction": 20,
+	}
+	for method, weight := range tests {
+		if w := l.Weight(method); w != weight {
+			t.Errorf("Unexpected weight %v of %s", w, method)
+		}
+	}
+
+	// The most specific of overlapping globs wins regardless of map order
+	for i := 0; i < 20; i++ {
+		l, _ = New(config.Limit{Weights: map[string]int{
+			"*":             3,
+			"eth_*":         5,
+			"eth_get*":      7,
+			"eth_get?ogs":   9,
+			"eth_getLogs":   11,
+			"eth_get[BT]*":  13,
+			"debug_trace*":  15,
+			"debug_*Block*": 17,
+		}})
+		tests = map[string]float64{
+			"eth_getLogs":            11,
+			"eth_getCode":            7,
+			"eth_getBlockByNumber":   13,
+			"eth_call":               5,
+			"net_version":            3,
+			"debug_traceBlockByHash": 15,
+		}
+		for method, weight := range tests {
+			if w := l.Weight(method); w != weight {
+				t.Fatalf("Unexpected weight %v of %s", w, method)
+			}
+		}
+	}
+
+	if _, err = New(config.Limit{Rate: -1}); err == nil {
+		t.Errorf("Negative rate should be rejected")
+	}
+	if _, err = New(config.Limit{Weights: map[string]int{"eth_[": 1}}); err == nil {
+		t.Errorf("Invalid pattern should be rejected")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	if l := GetInstance(); l.Take("a", 1000) != nil || l.slots != nil {
+		t.Errorf("Nothing should be limited before Configure")
+	}
+
+	Configure(config.Limit{Rate: 1, Burst: 10})
+	GetInstance().Take("a", 10)
+	Configure(config.Limit{Rate: 1, Burst: 20})
+	if err := GetInstance().Take("a", 5); err == nil {
+		t.Errorf("Buckets should be kept")
+	}
+	if Configure(config.Limit{Rate: -1}); GetInstance().cfg.Burst != 20 {
+		t.Errorf("Invalid limit should not replace the instance")
+	}
+}
+
+func TestTake(t *testing.T) {
+	l, _ := New(config.Limit{Rate: 2, Burst: 4})
+	now := time.Unix(1500000000, 0)
+	l.now = func() time.Time { return now }
+
+	if err := l.Take("a", 3); err != nil {
+		t.Fatalf("Burst should be allowed: %v", err)
+	}
+	if err := l.Take("b", 4); err != nil {
+		t.Fatalf("Clients should have own buckets: %v", err)
+	}
+	err := l.Take("a", 4)
+	if err == nil || err.Code != json.RateLimitedCode || err.RetryAfter != 2 {
+		t.Fatalf("Tokens should be exhausted: %v", err)
+	}
+
+	// Refilled by rate
+	now = now.Add(1500 * time.Millisecond)
+	if err = l.Take("a", 4); err != nil {
+		t.Errorf("Tokens should be refilled: %v", err)
+	}
+
+	// Weight over the burst needs a full bucket
+	now = now.Add(time.Hour)
+	if err = l.Take("a", 100); err != nil {
+		t.Errorf("Heavy request should be allowed with full bucket: %v", err)
+	}
+	if err = l.Take("a", 1); err == nil {
+		t.Errorf("Heavy request should drain bucket")
+	}
+
+	// Idle buckets are removed
+	now = now.Add(time.Hour)
+	l.Take("c", 1)
+	if len(l.buckets) != 1 {
+		t.Errorf("Idle buckets should be removed: %d", len(l.buckets))
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	l, _ := New(config.Limit{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: 1000})
+	release, err := l.Acquire(nil)
+	if err != nil {
+		t.Fatalf("Failed to acquire: %v", err)
+	}
+
+	// Second request waits in queue until the first is released
+	acquired := make(chan *json.RPCError)
+	go func() {
+		r, err := l.Acquire(context.Background())
+		if r != nil {
+			r()
+		}
+		acquired <- err
+	}()
+	for i := 0; i < 100 && atomic.LoadInt32(&l.waiting) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Third request overflows the queue
+	if _, err = l.Acquire(nil); err == nil || err.HTTPStatus() != 429 {
+		t.Errorf("Request over queue should be rejected: %v", err)
+	}
+
+	release()
+	if err = <-acquired; err != nil {
+		t.Errorf("Queued request should be served: %v", err)
+	}
+
+	// Wait is canceled with the request
+	release, _ = l.Acquire(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = l.Acquire(ctx); err == nil {
+		t.Errorf("Canceled request should not wait")
+	}
+	release()
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(nil) != "" || FromContext(context.Background()) != "" {
+		t.Errorf("Context without client should return blank")
+	}
+	if FromContext(NewContext(context.Background(), "1.2.3.4")) != "1.2.3.4" {
+		t.Errorf("Failed to carry client in context")
+	}
+}
+
+func TestClient(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Add("X-Forwarded-For", "198.51.100.1, 198.51.100.2")
+	r.Header.Add("X-Forwarded-For", "198.51.100.3")
+
+	tests := map[int]string{
+		0: "192.0.2.1",
+		1: "198.51.100.3",
+		2: "198.51.100.2",
+		5: "198.51.100.1",
+	}
+	for proxies, client := range tests {
+		l, _ := New(config.Limit{TrustedProxies: proxies})
+		if ret := l.Client(r); ret != client {
+			t.Errorf("Unexpected client %s behind %d proxies", ret, proxies)
+		}
+	}
+
+	r.Header.Del("X-Forwarded-For")
+	if l, _ := New(config.Limit{TrustedProxies: 1}); l.Client(r) != "192.0.2.1" {
+		t.Errorf("Remote address should be used without X-Forwarded-For")
+	}
+	if _, err := New(config.Limit{TrustedProxies: -1}); err == nil {
+		t.Errorf("Negative trusted proxies should be rejected")
+	}
+}
@@ -3,85 +3,626 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/hexoul/aws-lambda-eth-proxy/auth"
+	"github.com/hexoul/aws-lambda-eth-proxy/cache"
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
 	"github.com/hexoul/aws-lambda-eth-proxy/crypto"
-	_ "github.com/hexoul/aws-lambda-eth-proxy/ipfs"
+	"github.com/hexoul/aws-lambda-eth-proxy/health"
+	"github.com/hexoul/aws-lambda-eth-proxy/ipfs"
 	"github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/limiter"
 	"github.com/hexoul/aws-lambda-eth-proxy/log"
+	"github.com/hexoul/aws-lambda-eth-proxy/metrics"
+	"github.com/hexoul/aws-lambda-eth-proxy/policy"
 	"github.com/hexoul/aws-lambda-eth-proxy/predefined"
 	"github.com/hexoul/aws-lambda-eth-proxy/rpc"
+	"github.com/hexoul/aws-lambda-eth-proxy/ws"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-
-	"github.com/fvbock/endless"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 )
 
 const (
 	// ParamFuncName is a name indicating function's
 	ParamFuncName = "func"
-	// Targetnet indicates target network
-	Targetnet = rpc.Testnet
+	// WsPath is a path serving JSON-RPC over WebSocket
+	WsPath = "/ws"
+	// ChainPath is a path prefix selecting a chain by its name or chain ID
+	ChainPath = "/chain/"
+	// ChainHeader is a header selecting a chain by its name or chain ID
+	ChainHeader = "X-Chain-Id"
+	// MetricsPath is a path serving metrics in Prometheus text format
+	MetricsPath = "/metrics"
+	// MetricsNamespace is CloudWatch namespace of metrics dumped by Lambda
+	MetricsNamespace = "EthProxy"
+	// HealthPath is a path serving states of Ether nodes
+	HealthPath = "/health"
+	// ReadyPath is a path serving readiness to serve requests
+	ReadyPath = "/ready"
+	// QuorumHeader is a header giving the number of nodes whose majority must agree on reads
+	QuorumHeader = "X-Quorum"
+	// UpstreamHeader is a response header naming nodes which served requests
+	UpstreamHeader = "X-Upstream"
+	// UpstreamHeadHeader is a response header giving head blocks of the nodes in the same order
+	UpstreamHeadHeader = "X-Upstream-Head"
+	// Time to wait for requests in flight when server stops
+	shutdownTimeout = 30 * time.Second
+	// Time left to respond after requests to nodes are cancelled at the end of Lambda invocation
+	deadlineMargin = 200 * time.Millisecond
 )
 
 var (
 	lambdaHeaders = map[string]string{
 		"Content-Type":                     "application/json",
 		"Access-Control-Allow-Origin":      "*",
-		"Access-Control-Allow-Headers":     "Authorization, Origin, Accept, Referer, User-Agent, Content-Type, X-Requested-With, X-Api-Key, X-Amz-Date, X-Amz-Security-Token, X-Amz-User-Agent",
+		"Access-Control-Allow-Headers":     "Authorization, Origin, Accept, Referer, User-Agent, Content-Type, X-Requested-With, X-Api-Key, X-Chain-Id, X-Quorum, X-Amz-Date, X-Amz-Security-Token, X-Amz-User-Agent",
 		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Expose-Headers":    "Retry-After, X-Upstream, X-Upstream-Head",
 	}
+	// notificationID is used to relay a notification to Ether node
+	// because the node also does not reply to a request without id
+	notificationID = []byte(`"notification"`)
+	// emfOut is where Lambda dumps metrics in embedded metric format
+	emfOut io.Writer = os.Stdout
+	// checker reports health and readiness
+	// Crypto key is required for readiness once it is given
+	checker = health.New(false)
+)
+
+// For metrics
+var (
+	requests        = metrics.GetInstance().Counter("eth_proxy_requests_total", "JSON-RPC requests by method and error code", "chain", "method", "code")
+	requestDuration = metrics.GetInstance().Histogram("eth_proxy_request_duration_seconds", "Latency of JSON-RPC request", metrics.DefBuckets, "chain", "method")
 )
 
-func handler(req json.RPCRequest) (body string, statusCode int) {
+// forward delivers RPC request to predefined function or Ether node
+// of the chain carried by ctx and returns JSON-RPC response body with its error if failed
+func forward(ctx context.Context, req json.RPCRequest) (body []byte, rpcErr *json.RPCError) {
 	log.Info("request:", req.String())
-	var resp json.RPCResponse
+	defer observe(ctx, req, time.Now(), &rpcErr)
+	if req.IsNotification() {
+		req.ID = notificationID
+	}
+	if rpcErr = admit(ctx, req); rpcErr != nil {
+		log.Info("rejected: ", rpcErr.Error())
+		body, _ = errorResponse(req, rpcErr)
+		return
+	}
+
 	var err error
 	if predefined.Contains(req.Method) {
 		// Forward RPC request to predefined function
-		resp, err = predefined.Forward(req)
+		// Response is re-marshalled because it is post-processed
+		var resp json.RPCResponse
+		if resp, err = predefined.Forward(ctx, req); err == nil {
+			resp.ID = req.ID
+			resp.Jsonrpc = json.Version
+			body = []byte(resp.String())
+		}
 	} else {
 		// Forward RPC request to Ether node
+		// Relay a response from the node as it is, except id
 		var respBody string
-		if respBody, err = rpc.GetInstance().DoRPC(req); err == nil {
-			// Relay a response from the node
-			resp = json.GetRPCResponseFromJSON(respBody)
+		if respBody, err = doRPC(ctx, req); err != nil {
+			err = json.NewUpstreamError(err)
+		} else if body, err = json.ReplaceID([]byte(respBody), req.ID); err != nil {
+			err = json.NewRPCError(json.UpstreamUnavailableCode, "invalid response from node")
 		}
 	}
 
-	statusCode = 200
 	if err != nil {
 		// In case of server-side RPC fail
 		log.Error(err.Error())
-		resp.Error = &json.RPCError{
-			Code:    -1,
-			Message: err.Error(),
-		}
-		statusCode = 400
+		rpcErr = json.ToRPCError(err)
+		body, _ = errorResponse(req, rpcErr)
 	}
-	body = resp.String()
 	return
 }
 
+// observe records a request served since start with its error
+func observe(ctx context.Context, req json.RPCRequest, start time.Time, rpcErr **json.RPCError) {
+	chain := rpc.FromContext(ctx).NetType
+	code := "0"
+	if *rpcErr != nil {
+		code = strconv.Itoa(int((*rpcErr).Code))
+	}
+	requests.Inc(chain, req.Method, code)
+	requestDuration.Observe(time.Since(start).Seconds(), chain, req.Method)
+}
+
+// doRPC invokes RPC request to Ether node of the chain carried by ctx
+// through cache when it is enabled
+func doRPC(ctx context.Context, req json.RPCRequest) (string, error) {
+	r := rpc.FromContext(ctx)
+	// Quorum reads are never served from cache
+	if n := quorum(ctx, r, req.Method); n > 1 {
+		resp, routes, err := r.DoRPCQuorumContext(ctx, req, n)
+		for _, route := range routes {
+			routesFromContext(ctx).add(route)
+		}
+		return resp, err
+	}
+	fetch := func() (string, error) {
+		resp, route, err := r.DoRPCRouteContext(ctx, req)
+		if err == nil {
+			routesFromContext(ctx).add(route)
+		}
+		return resp, err
+	}
+	c := cache.GetInstance()
+	if c == nil {
+		return fetch()
+	}
+	return c.Do(ctx, r.NetType, req, fetch)
+}
+
+// quorumKey is a context key for the number of nodes given by QuorumHeader
+type quorumKey struct{}
+
+// withQuorum returns context carrying quorum given by QuorumHeader
+// Blank value means quorum follows config of methods
+func withQuorum(ctx context.Context, value string) (context.Context, *json.RPCError) {
+	if value == "" {
+		return ctx, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return ctx, json.NewInvalidRequest("invalid " + QuorumHeader)
+	}
+	return context.WithValue(ctx, quorumKey{}, n), nil
+}
+
+// quorum returns the number of nodes to agree on a read of the method
+// QuorumHeader carried by ctx precedes config
+func quorum(ctx context.Context, r *rpc.RPC, method string) int {
+	if !json.IsIdempotent(method) {
+		return 0
+	}
+	if n, ok := ctx.Value(quorumKey{}).(int); ok {
+		return n
+	}
+	return r.Quorum(method)
+}
+
+// routes collects nodes which served requests of an HTTP request
+type routes struct {
+	mu   sync.Mutex
+	list []rpc.Route
+}
+
+// routesKey is a context key for routes
+type routesKey struct{}
+
+// withRoutes returns context collecting routes
+func withRoutes(ctx context.Context) (context.Context, *routes) {
+	rs := &routes{}
+	return context.WithValue(ctx, routesKey{}, rs), rs
+}
+
+// routesFromContext returns routes carried by ctx, which may be nil
+func routesFromContext(ctx context.Context) *routes {
+	rs, _ := ctx.Value(routesKey{}).(*routes)
+	return rs
+}
+
+// add records a route once
+func (rs *routes) add(route rpc.Route) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, r := range rs.list {
+		if r == route {
+			return
+		}
+	}
+	rs.list = append(rs.list, route)
+}
+
+// header adds routes to header, which is made when it is nil
+// Nothing is added without route, e.g. when responses are from cache
+func (rs *routes) header(header http.Header) http.Header {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.list) == 0 {
+		return header
+	}
+	nodes := make([]string, len(rs.list))
+	heads := make([]string, len(rs.list))
+	for i, r := range rs.list {
+		nodes[i], heads[i] = r.Node, "unknown"
+		if r.Head > 0 {
+			heads[i] = hexutil.EncodeUint64(r.Head)
+		}
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set(UpstreamHeader, strings.Join(nodes, ", "))
+	header.Set(UpstreamHeadHeader, strings.Join(heads, ", "))
+	return header
+}
+
+// admit returns RPCError when the request is not allowed to be relayed
+// by policy or by API key carried in ctx
+func admit(ctx context.Context, req json.RPCRequest) *json.RPCError {
+	if rpcErr := policy.GetInstance().Check(ctx, req); rpcErr != nil {
+		return rpcErr
+	}
+	// Authentication may be disabled by reload after the key was given
+	if key, a := auth.FromContext(ctx), auth.GetInstance(); key != nil && a != nil {
+		return a.Authorize(key, req.Method)
+	}
+	return nil
+}
+
+// authenticate validates API key and returns context carrying it
+// ctx is returned as it is when authentication is disabled
+func authenticate(ctx context.Context, apiKey, origin string) (context.Context, *json.RPCError) {
+	a := auth.GetInstance()
+	if a == nil {
+		return ctx, nil
+	}
+	key, rpcErr := a.Authenticate(apiKey, origin)
+	if rpcErr != nil {
+		log.Info("unauthenticated: ", rpcErr.Error())
+		return ctx, rpcErr
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return auth.NewContext(ctx, key), nil
+}
+
+// errorResponse returns JSON-RPC error response and HTTP status code for it
+func errorResponse(req json.RPCRequest, rpcErr *json.RPCError) ([]byte, int) {
+	resp := json.RPCResponse{
+		Jsonrpc: json.Version,
+		ID:      req.ID,
+		Error:   rpcErr,
+	}
+	return []byte(resp.String()), rpcErr.HTTPStatus()
+}
+
+// errorHeader returns HTTP header to be served with the error
+func errorHeader(rpcErr *json.RPCError) http.Header {
+	if rpcErr == nil || rpcErr.RetryAfter <= 0 {
+		return nil
+	}
+	return http.Header{"Retry-After": []string{strconv.Itoa(rpcErr.RetryAfter)}}
+}
+
+func handler(ctx context.Context, req json.RPCRequest) (body string, statusCode int, header http.Header) {
+	resp, rpcErr := forward(ctx, req)
+	if req.IsNotification() {
+		return "", http.StatusNoContent, nil
+	}
+	if rpcErr != nil {
+		return string(resp), rpcErr.HTTPStatus(), errorHeader(rpcErr)
+	}
+	return string(resp), 200, nil
+}
+
+// batchHandler handles JSON-RPC batch request
+// Each request is forwarded in order and responses keep the order of requests
+// Invalid element gets its own error response without failing the others
+// and notifications are excluded from responses
+func batchHandler(ctx context.Context, reqs []json.RPCRequest, errs []*json.RPCError) (body string, statusCode int) {
+	if len(reqs) == 0 {
+		resp, statusCode := errorResponse(json.RPCRequest{}, json.NewInvalidRequest("empty batch"))
+		return string(resp), statusCode
+	}
+
+	resps := make([][]byte, 0, len(reqs))
+	for i, req := range reqs {
+		if errs[i] != nil {
+			resp, _ := errorResponse(req, errs[i])
+			resps = append(resps, resp)
+			continue
+		}
+		resp, _ := forward(ctx, req)
+		if !req.IsNotification() {
+			resps = append(resps, resp)
+		}
+	}
+
+	if len(resps) == 0 {
+		return "", http.StatusNoContent
+	}
+	return string(json.JoinBatch(resps)), 200
+}
+
+// bodyHandler handles JSON-RPC request body which may be a batch
+// method overrides the method of single request when it is given
+// header is additional HTTP header for response, which may be nil
+func bodyHandler(ctx context.Context, body, method string) (respBody string, statusCode int, header http.Header) {
+	ctx, served := withRoutes(ctx)
+	defer func() { header = served.header(header) }()
+	reqs, errs, isBatch := json.GetRPCRequestsFromJSON(body)
+	if !isBatch && method != "" {
+		if errs[0] != nil && errs[0].Code == json.ParseErrorCode {
+			// Request is given by path or query only
+			reqs[0] = json.RPCRequest{
+				Jsonrpc: json.Version,
+				Method:  method,
+				ID:      []byte("null"),
+			}
+			errs[0] = nil
+		} else {
+			// Params and id of body are kept
+			reqs[0].Method = method
+			errs[0] = reqs[0].Validate()
+		}
+	}
+
+	if rpcErr := limit(ctx, reqs, errs); rpcErr != nil {
+		var req json.RPCRequest
+		if !isBatch {
+			req = reqs[0]
+		}
+		resp, statusCode := errorResponse(req, rpcErr)
+		return string(resp), statusCode, errorHeader(rpcErr)
+	}
+
+	if isBatch {
+		respBody, statusCode = batchHandler(ctx, reqs, errs)
+		return
+	}
+	if errs[0] != nil {
+		resp, statusCode := errorResponse(reqs[0], errs[0])
+		return string(resp), statusCode, nil
+	}
+	return handler(ctx, reqs[0])
+}
+
+// limit takes tokens of requests from the client carried by ctx
+// Every valid request in a batch is weighted by its method
+func limit(ctx context.Context, reqs []json.RPCRequest, errs []*json.RPCError) *json.RPCError {
+	client := limiter.FromContext(ctx)
+	if client == "" {
+		return nil
+	}
+	l := limiter.GetInstance()
+	var weight float64
+	for i, req := range reqs {
+		if errs[i] == nil {
+			weight += l.Weight(req.Method)
+		}
+	}
+	if rpcErr := l.Take(client, weight); rpcErr != nil {
+		log.Info("rate limited: ", client)
+		return rpcErr
+	}
+	return nil
+}
+
 // lambdaHandler handles APIGatewayProxyRequest as JSON-RPC request
+// Metrics are dumped in logs after every invocation
 func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Validate RPC request
-	req := json.GetRPCRequestFromJSON(request.Body)
-	if method := request.QueryStringParameters[ParamFuncName]; method != "" {
-		req.Method = method
-	} else if method := request.PathParameters[ParamFuncName]; method != "" {
-		req.Method = method
+	defer func() {
+		metrics.GetInstance().WriteEMF(emfOut, MetricsNamespace, time.Now())
+	}()
+	method := request.QueryStringParameters[ParamFuncName]
+	if method == "" {
+		method = request.PathParameters[ParamFuncName]
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := withDeadline(ctx)
+	defer cancel()
+	switch request.Path {
+	case HealthPath:
+		report := checker.Health(ctx)
+		return events.APIGatewayProxyResponse{Headers: lambdaHeaders, Body: report.String(), StatusCode: report.StatusCode()}, nil
+	case ReadyPath:
+		report := checker.Ready(ctx)
+		return events.APIGatewayProxyResponse{Headers: lambdaHeaders, Body: report.String(), StatusCode: report.StatusCode()}, nil
+	}
+	apiKey := lambdaHeader(request.Headers, auth.Header)
+	if apiKey == "" {
+		apiKey = request.QueryStringParameters[auth.QueryParam]
+	}
+	ctx, rpcErr := authenticate(ctx, apiKey, lambdaHeader(request.Headers, "Origin"))
+	if rpcErr != nil {
+		resp, statusCode := errorResponse(json.RPCRequest{}, rpcErr)
+		return events.APIGatewayProxyResponse{Headers: lambdaHeaders, Body: string(resp), StatusCode: statusCode}, nil
+	}
+	r, _, rpcErr := resolveChain(request.Path, lambdaHeader(request.Headers, ChainHeader))
+	if rpcErr != nil {
+		resp, _ := errorResponse(json.RPCRequest{}, rpcErr)
+		return events.APIGatewayProxyResponse{Headers: lambdaHeaders, Body: string(resp), StatusCode: http.StatusNotFound}, nil
+	}
+	ctx = rpc.NewContext(ctx, r)
+	if ctx, rpcErr = withQuorum(ctx, lambdaHeader(request.Headers, QuorumHeader)); rpcErr != nil {
+		resp, statusCode := errorResponse(json.RPCRequest{}, rpcErr)
+		return events.APIGatewayProxyResponse{Headers: lambdaHeaders, Body: string(resp), StatusCode: statusCode}, nil
+	}
+
+	respBody, statusCode, header := bodyHandler(ctx, request.Body, method)
+	headers := lambdaHeaders
+	if len(header) > 0 {
+		headers = make(map[string]string, len(lambdaHeaders)+len(header))
+		for k, v := range lambdaHeaders {
+			headers[k] = v
+		}
+		for k := range header {
+			headers[k] = header.Get(k)
+		}
+	}
+	return events.APIGatewayProxyResponse{Headers: headers, Body: respBody, StatusCode: statusCode}, nil
+}
+
+// withDeadline returns context which ends deadlineMargin before Lambda invocation
+// so that requests to nodes are cancelled in time to respond
+func withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(ctx, deadline.Add(-deadlineMargin))
+	}
+	return context.WithCancel(ctx)
+}
+
+// lambdaHeader returns a value of request header regardless of its case
+// because API Gateway passes header names as clients send them
+func lambdaHeader(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// authHandler authenticates http.Request ahead of next handler
+// Authenticated API key is carried by context of the request
+func authHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get(auth.Header)
+		if apiKey == "" {
+			apiKey = r.URL.Query().Get(auth.QueryParam)
+		}
+		ctx, rpcErr := authenticate(r.Context(), apiKey, r.Header.Get("Origin"))
+		if rpcErr != nil {
+			resp, statusCode := errorResponse(json.RPCRequest{}, rpcErr)
+			writeResponse(w, string(resp), statusCode, nil)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// limitHandler identifies a client of http.Request to be rate limited
+// Authenticated API key is preferred to IP address shared by users behind NAT
+func limitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := limiter.GetInstance().Client(r)
+		if key := auth.FromContext(r.Context()); key != nil {
+			client = "key:" + key.Key
+		}
+		next.ServeHTTP(w, r.WithContext(limiter.NewContext(r.Context(), client)))
+	})
+}
+
+// resolveChain returns RPC of the chain selected by path or header and the rest of path
+// Path is either /chain/{name or chain ID}/..., /{name}/... or anything else
+// served by the chain of header, or default chain without the header
+func resolveChain(path, header string) (r *rpc.RPC, rest string, rpcErr *json.RPCError) {
+	name, rest := "", path
+	if strings.HasPrefix(path, ChainPath) {
+		name, rest = splitPath(strings.TrimPrefix(path, ChainPath))
+	} else if first, remain := splitPath(strings.TrimPrefix(path, "/")); first != "" && rpc.Get(first) != nil {
+		name, rest = first, remain
+	} else {
+		name = header
+	}
+
+	if name == "" {
+		r = rpc.GetInstance()
+	} else if r = rpc.Get(name); r == nil {
+		if chainID, ok := new(big.Int).SetString(name, 10); ok {
+			r = rpc.GetByChainID(chainID)
+		}
+	}
+	if r == nil {
+		return nil, "", json.NewRPCError(json.InvalidRequestCode, "unknown chain "+name)
+	}
+	return r, rest, nil
+}
+
+// splitPath returns the first segment of path and the rest beginning with slash
+func splitPath(path string) (first, rest string) {
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i:]
+	}
+	return path, "/"
+}
+
+// router serves JSON-RPC of the chain selected by path or header
+// over HTTP, or over WebSocket at WsPath under the chain
+type router struct {
+	mu sync.Mutex
+	// chain name => WebSocket server sharing subscriptions of the chain
+	servers map[string]*ws.Server
+	hubs    map[string]*ws.Hub
+}
+
+func newRouter() *router {
+	return &router{
+		servers: make(map[string]*ws.Server),
+		hubs:    make(map[string]*ws.Hub),
 	}
+}
 
-	respBody, statusCode := handler(req)
-	return events.APIGatewayProxyResponse{Headers: lambdaHeaders, Body: respBody, StatusCode: statusCode}, nil
+// ServeHTTP dispatches http.Request with context carrying RPC of the chain
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	chain, rest, rpcErr := resolveChain(r.URL.Path, r.Header.Get(ChainHeader))
+	if rpcErr != nil {
+		resp, _ := errorResponse(json.RPCRequest{}, rpcErr)
+		writeResponse(w, string(resp), http.StatusNotFound, nil)
+		return
+	}
+	ctx, rpcErr := withQuorum(rpc.NewContext(r.Context(), chain), r.Header.Get(QuorumHeader))
+	if rpcErr != nil {
+		resp, statusCode := errorResponse(json.RPCRequest{}, rpcErr)
+		writeResponse(w, string(resp), statusCode, nil)
+		return
+	}
+	r = r.WithContext(ctx)
+	if rest == WsPath {
+		rt.wsServer(chain.NetType).ServeHTTP(w, r)
+		return
+	}
+	httpHandler(w, r)
+}
+
+// wsServer returns WebSocket server of the chain, making it at first
+func (rt *router) wsServer(name string) *ws.Server {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if s, ok := rt.servers[name]; ok {
+		return s
+	}
+	hub := ws.NewHub(func() config.Upstream {
+		// Chain may be removed by reload
+		if r := rpc.Get(name); r != nil {
+			return r.GetWsUpstream()
+		}
+		return config.Upstream{}
+	})
+	rt.hubs[name] = hub
+	rt.servers[name] = ws.NewServer(hub, wsHandler, admit)
+	return rt.servers[name]
+}
+
+// Reconnect moves subscriptions of every chain to new upstream
+func (rt *router) Reconnect() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, hub := range rt.hubs {
+		hub.Reconnect()
+	}
 }
 
 // httpHandler handles http.Request as JSON-RPC request
+// Requests over in-flight cap wait in queue and are rejected when it is full
 func httpHandler(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
@@ -90,12 +631,41 @@ func httpHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req := json.GetRPCRequestFromJSON(string(b))
-	respBody, statusCode := handler(req)
+	release, rpcErr := limiter.GetInstance().Acquire(r.Context())
+	if rpcErr != nil {
+		resp, statusCode := errorResponse(json.RPCRequest{}, rpcErr)
+		writeResponse(w, string(resp), statusCode, errorHeader(rpcErr))
+		return
+	}
+	respBody, statusCode, header := bodyHandler(r.Context(), string(b), "")
+	release()
+	writeResponse(w, respBody, statusCode, header)
+}
+
+// writeResponse writes JSON-RPC response body with HTTP status and header
+func writeResponse(w http.ResponseWriter, respBody string, statusCode int, header http.Header) {
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	if statusCode != http.StatusNoContent {
+		w.Header().Set("Content-Type", rpc.ContentType)
+	}
 	w.WriteHeader(statusCode)
 	w.Write([]byte(respBody))
 }
 
+// wsHandler handles JSON-RPC message except subscription over WebSocket
+func wsHandler(ctx context.Context, body string) string {
+	release, rpcErr := limiter.GetInstance().Acquire(ctx)
+	if rpcErr != nil {
+		resp, _ := errorResponse(json.RPCRequest{}, rpcErr)
+		return string(resp)
+	}
+	defer release()
+	respBody, _, _ := bodyHandler(ctx, body, "")
+	return respBody
+}
+
 func help() {
 	fmt.Println("USAGE")
 	fmt.Println("  Option 1. key path only as argument")
@@ -108,8 +678,72 @@ func help() {
 	fmt.Println("    $> proxy")
 }
 
+// applyConfig applies settings which can be changed at runtime
+func applyConfig(cfg *config.Config) {
+	rpc.Configure(cfg.AllChains(), cfg.RPC)
+	cache.Configure(cfg.Cache)
+	policy.Configure(cfg.Policy)
+	auth.Configure(cfg.Auth)
+	limiter.Configure(cfg.Limit)
+	ipfs.Configure(cfg.IPFS.Urls)
+}
+
+// reload applies config file again
+// Network and port are kept until restart because they are bound at startup
+func reload(rt *router) {
+	old := config.GetInstance()
+	cfg, err := config.Reload()
+	if err != nil {
+		log.Error("Failed to reload config, ", err)
+		return
+	}
+	if cfg.Network != old.Network || cfg.Port != old.Port {
+		log.Warn("Network and port are changed after restart")
+	}
+	applyConfig(cfg)
+	// Move subscriptions to new upstream
+	rt.Reconnect()
+	log.Info("Config reloaded")
+}
+
+// listenAndServe serves HTTP until SIGINT or SIGTERM
+// and reloads config on SIGHUP
+func listenAndServe(srv *http.Server, rt *router) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				reload(rt)
+				continue
+			}
+			log.Info("Server stopping...")
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Error("Failed to stop gracefully, ", err)
+			}
+			cancel()
+			return
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Panic(err)
+	}
+	// Wait for requests in flight
+	<-done
+}
+
 func init() {
-	rpc.NetType = Targetnet
+	head := func(ctx context.Context) (uint64, error) {
+		return rpc.FromContext(ctx).GetBlockNumberContext(ctx)
+	}
+	policy.GetInstance().SetHead(head)
+	if c := cache.GetInstance(); c != nil {
+		c.SetHead(head)
+	}
 
 	// Initialize Crypto with arguments
 	var path, passphrase string
@@ -133,16 +767,29 @@ func init() {
 		crypto.PathChan <- path
 		crypto.PassphraseChan <- passphrase
 	}()
+	checker = health.New(true)
 	crypto.GetInstance()
 }
 
 func main() {
 	log.Info("Server starting...")
+	// Reload returns an error instead of panicking on config missing URLs
+	cfg, err := config.Reload()
+	if err != nil {
+		log.Fatal("Failed to load config, ", err)
+	}
+	rpc.NetType = cfg.Network
+	applyConfig(cfg)
+
 	if os.Getenv(crypto.IsLambda) == "FALSE" {
 		log.Info("Ready to start HTTP/HTTPS")
+		rt := newRouter()
 		h := http.NewServeMux()
-		h.HandleFunc("/", httpHandler)
-		endless.ListenAndServe(":8545", h)
+		h.Handle(MetricsPath, metrics.GetInstance())
+		h.Handle(HealthPath, checker.HealthHandler())
+		h.Handle(ReadyPath, checker.ReadyHandler())
+		h.Handle("/", authHandler(limitHandler(rt)))
+		listenAndServe(&http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: h}, rt)
 	} else {
 		log.Info("Ready to start Lambda")
 		lambda.Start(lambdaHandler)
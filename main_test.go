@@ -1,12 +1,25 @@
 package main
 
 import (
+	"context"
+	stdjson "encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hexoul/aws-lambda-eth-proxy/auth"
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
 	"github.com/hexoul/aws-lambda-eth-proxy/crypto"
 	"github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/limiter"
+	"github.com/hexoul/aws-lambda-eth-proxy/metrics"
+	"github.com/hexoul/aws-lambda-eth-proxy/rpc"
 
 	"github.com/aws/aws-lambda-go/events"
 )
@@ -27,21 +40,75 @@ func testArg() {
 	os.Args[2] = ""
 }
 
+// testNodeResults is canned results of testNode following method
+var testNodeResults = map[string]interface{}{
+	"net_version":     "3",
+	"eth_gasPrice":    "0x3b9aca00",
+	"eth_blockNumber": "0x10",
+	"eth_getBalance":  "0xde0b6b3a7640000",
+}
+
+// testNodeRawResults is canned raw responses of testNode having id as format
+var testNodeRawResults = map[string]string{
+	"eth_syncing": `{"jsonrpc":"2.0", "id":%s, "result":{"currentBlock":"0x1","highestBlock":"0x2","knownStates":1e3}, "extra":[1,2]}` + "\n",
+}
+
+// testNode imitates ethereum node
+func testNode() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		req, _ := json.GetRPCRequestFromJSON(string(b))
+		if raw, ok := testNodeRawResults[req.Method]; ok {
+			fmt.Fprintf(w, raw, req.ID)
+			return
+		}
+		resp := json.RPCResponse{
+			Jsonrpc: "2.0",
+			ID:      req.ID,
+		}
+		if result, ok := testNodeResults[req.Method]; ok {
+			resp.Result = result
+		} else {
+			resp.Error = json.NewMethodNotFound(req.Method)
+		}
+		w.Write([]byte(resp.String()))
+	}))
+}
+
+// serve handles body without API key
+func serve(body, method string) (string, int) {
+	respBody, statusCode, _ := bodyHandler(context.Background(), body, method)
+	return respBody, statusCode
+}
+
 // FIXME: os.Setenv is not reflected to main()
 func TestMain(m *testing.M) {
 	//testHelp()
 	//testEnv()
 	testArg()
 
+	node := testNode()
+	rpc.Configure(map[string]config.Chain{
+		rpc.Testnet: {Urls: []string{node.URL}},
+		"side":      {ChainID: 137, Urls: []string{node.URL}},
+	}, config.Default().RPC)
+
+	emfOut = ioutil.Discard
+
+	// Rate limiting is off unless its config is given
+	limiter.Configure(config.Limit{Rate: 50, Burst: 100, Weights: map[string]int{"eth_getLogs": 10}})
+
 	flag.Parse()
-	os.Exit(m.Run())
+	ret := m.Run()
+	node.Close()
+	os.Exit(ret)
 }
 
 func TestLambdaHandler(t *testing.T) {
 	req := json.RPCRequest{
 		Jsonrpc: "2.0",
 		Method:  "eth_getBalance",
-		ID:      1,
+		ID:      []byte("1"),
 	}
 	req.Params = append(req.Params, "0xeeaf5f87cb85433a0db0fc31863b21d1c8279f7d")
 	req.Params = append(req.Params, "latest")
@@ -53,3 +120,360 @@ func TestLambdaHandler(t *testing.T) {
 		t.Errorf("Failed to start main")
 	}
 }
+
+func TestWithDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	parent, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	ctx, cancel := withDeadline(parent)
+	defer cancel()
+	if d, ok := ctx.Deadline(); !ok || !d.Equal(deadline.Add(-deadlineMargin)) {
+		t.Errorf("Deadline should leave margin to respond: %s", d)
+	}
+	ctx, cancel = withDeadline(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("Context without deadline should have no deadline")
+	}
+
+	// Lambda invocation about to end answers with upstream timeout
+	parent, cancel = context.WithDeadline(context.Background(), time.Now().Add(deadlineMargin))
+	defer cancel()
+	resp, _ := lambdaHandler(parent, events.APIGatewayProxyRequest{
+		Body: `{"jsonrpc":"2.0","method":"eth_getCode","params":["0x1","latest"],"id":1}`,
+	})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expired request should time out: %d %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	body := `[
+		{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1},
+		{"jsonrpc":"2.0","method":"eth_getBalance","params":["0xeeaf5f87cb85433a0db0fc31863b21d1c8279f7d","latest","ether"],"id":2},
+		{"jsonrpc":"2.0","method":"foo","params":[],"id":3}
+	]`
+	resp, err := lambdaHandler(nil, events.APIGatewayProxyRequest{
+		Body: body,
+	})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Failed to handle batch: %d %v", resp.StatusCode, err)
+	}
+	if !strings.HasPrefix(resp.Body, "[") {
+		t.Fatalf("Batch response is not array: %s", resp.Body)
+	}
+
+	expected := []struct {
+		id     string
+		result interface{}
+	}{
+		{"1", "0x10"},
+		{"2", "1"},
+		{"3", nil},
+	}
+	var resps []json.RPCResponse
+	if err := stdjson.Unmarshal([]byte(resp.Body), &resps); err != nil || len(resps) != len(expected) {
+		t.Fatalf("Failed to deserialize batch response: %s", resp.Body)
+	}
+	for i, e := range expected {
+		if string(resps[i].ID) != e.id || resps[i].Result != e.result {
+			t.Errorf("Unexpected response %d: %v", i, resps[i])
+		}
+	}
+}
+
+func TestHTTPHandlerBatch(t *testing.T) {
+	body := `[{"jsonrpc":"2.0","method":"foo","params":[],"id":7},{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":8}]`
+	rec := httptest.NewRecorder()
+	httpHandler(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	var resps []json.RPCResponse
+	if err := stdjson.Unmarshal(rec.Body.Bytes(), &resps); err != nil || len(resps) != 2 {
+		t.Fatalf("Failed to deserialize batch response: %s", rec.Body.String())
+	}
+	if string(resps[0].ID) != "7" || string(resps[1].ID) != "8" || resps[1].Result != "0x10" {
+		t.Errorf("Unexpected batch response: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	httpHandler(rec, httptest.NewRequest("POST", "/", strings.NewReader("[]")))
+	if rec.Code != 400 {
+		t.Errorf("Empty batch should be rejected")
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	tests := []struct {
+		body   string
+		status int
+		code   int32
+	}{
+		{`{"jsonrpc":"2.0","method":"eth_blockNumber"`, 400, json.ParseErrorCode},
+		{`{"jsonrpc":"2.0","params":[],"id":1}`, 400, json.InvalidRequestCode},
+		{`{"jsonrpc":"2.0","method":"eth_getBalance","params":["0x0","latest",1],"id":1}`, 200, json.InvalidParamsCode},
+		{`{"jsonrpc":"2.0","method":"eth_unknown","params":[],"id":1}`, 200, json.MethodNotFoundCode},
+		{`[]`, 400, json.InvalidRequestCode},
+	}
+	for _, test := range tests {
+		body, status := serve(test.body, "")
+		resp := json.GetRPCResponseFromJSON(body)
+		if status != test.status || resp.Error == nil || resp.Error.Code != test.code {
+			t.Errorf("Unexpected response %d %s for %s", status, body, test.body)
+		}
+	}
+
+	body, _ := serve(`[{"jsonrpc":"2.0","method":"foo","id":1},{"jsonrpc":"2.0","id":2}]`, "")
+	var resps []json.RPCResponse
+	if err := stdjson.Unmarshal([]byte(body), &resps); err != nil || len(resps) != 2 {
+		t.Fatalf("Failed to deserialize batch response: %s", body)
+	}
+	if resps[0].Error != nil || resps[1].Error == nil || resps[1].Error.Code != json.InvalidRequestCode || string(resps[1].ID) != "2" {
+		t.Errorf("Invalid element of batch should not fail others: %s", body)
+	}
+}
+
+func TestHandlerID(t *testing.T) {
+	ids := []string{`"abc-123"`, `18446744073709551616123`, `-7`, `0.5`, `null`}
+	for _, id := range ids {
+		body, status := serve(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":`+id+`}`, "")
+		if status != 200 || body != `{"jsonrpc":"2.0","id":`+id+`,"result":"0x10"}` {
+			t.Errorf("Failed to relay id %s: %d %s", id, status, body)
+		}
+	}
+
+	// Predefined function also keeps id
+	body, _ := serve(`{"jsonrpc":"2.0","method":"eth_getBalance","params":["0x0","latest","ether"],"id":"bal"}`, "")
+	if body != `{"jsonrpc":"2.0","id":"bal","result":"1"}` {
+		t.Errorf("Failed to relay id for predefined: %s", body)
+	}
+}
+
+func TestHandlerNotification(t *testing.T) {
+	body, status := serve(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[]}`, "")
+	if status != 204 || body != "" {
+		t.Errorf("Notification should not be replied: %d %s", status, body)
+	}
+
+	body, status = serve(`[{"jsonrpc":"2.0","method":"foo"},{"jsonrpc":"2.0","method":"eth_blockNumber","params":[]}]`, "")
+	if status != 204 || body != "" {
+		t.Errorf("Batch of notifications should not be replied: %d %s", status, body)
+	}
+
+	body, _ = serve(`[{"jsonrpc":"2.0","method":"foo"},{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":"x"}]`, "")
+	if body != `[{"jsonrpc":"2.0","id":"x","result":"0x10"}]` {
+		t.Errorf("Only requests should be replied in batch: %s", body)
+	}
+
+	rec := httptest.NewRecorder()
+	httpHandler(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"jsonrpc":"2.0","method":"foo"}`)))
+	if rec.Code != 204 || rec.Body.Len() != 0 {
+		t.Errorf("Notification should not be replied over HTTP: %d", rec.Code)
+	}
+
+	// Invalid request is replied even if it has no id
+	body, status = serve(`{"jsonrpc":"1.0","method":"foo"}`, "")
+	if status != 400 || body != `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid Request","data":"jsonrpc must be 2.0"}}` {
+		t.Errorf("Invalid request should be replied: %d %s", status, body)
+	}
+}
+
+func TestHandlerVersion(t *testing.T) {
+	tests := map[string]int{
+		`{"jsonrpc":"2.0","method":"foo","id":1}`:  200,
+		`{"jsonrpc":"1.0","method":"foo","id":1}`:  400,
+		`{"jsonrpc":2,"method":"foo","id":1}`:      400,
+		`{"method":"foo","id":1}`:                  400,
+		`{"jsonrpc":"2.0","method":"foo","id":{}}`: 400,
+	}
+	for body, status := range tests {
+		if ret, s := serve(body, ""); s != status {
+			t.Errorf("Unexpected status %d for %s: %s", s, body, ret)
+		}
+	}
+
+	// Method given by path or query is still served without body
+	if body, status := serve("", "eth_blockNumber"); status != 200 || body != `{"jsonrpc":"2.0","id":null,"result":"0x10"}` {
+		t.Errorf("Failed to handle request by func param: %d %s", status, body)
+	}
+	// Body without method keeps its params and id
+	body, status := serve(`{"jsonrpc":"2.0","params":["0xeeaf5f87cb85433a0db0fc31863b21d1c8279f7d","latest","ether"],"id":5}`, "eth_getBalance")
+	if status != 200 || body != `{"jsonrpc":"2.0","id":5,"result":"1"}` {
+		t.Errorf("Params and id of body should be kept for func param: %d %s", status, body)
+	}
+	if body, status = serve(`{"jsonrpc":"1.0","id":5}`, "eth_getBalance"); status != 400 {
+		t.Errorf("Invalid body should be rejected for func param: %d %s", status, body)
+	}
+}
+
+func TestHandlerPassthrough(t *testing.T) {
+	body, status := serve(`{"jsonrpc":"2.0","method":"eth_syncing","params":[],"id":"sync"}`, "")
+	expected := fmt.Sprintf(testNodeRawResults["eth_syncing"], `"sync"`)
+	if status != 200 || body != expected {
+		t.Errorf("Response should be relayed byte for byte: %s", body)
+	}
+
+	body, _ = serve(`[{"jsonrpc":"2.0","method":"eth_syncing","params":[],"id":1},{"jsonrpc":"2.0","method":"foo","id":2}]`, "")
+	expected = "[" + fmt.Sprintf(testNodeRawResults["eth_syncing"], "1") + `,{"jsonrpc":"2.0","id":2}]`
+	if body != expected {
+		t.Errorf("Batch response should be relayed byte for byte: %s", body)
+	}
+}
+
+func TestHandlerPolicy(t *testing.T) {
+	body, status := serve(`{"jsonrpc":"2.0","method":"personal_unlockAccount","params":[],"id":1}`, "")
+	resp := json.GetRPCResponseFromJSON(body)
+	if status != 200 || resp.Error == nil || resp.Error.Code != json.MethodNotSupportedCode {
+		t.Errorf("Method should be denied by policy: %s", body)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	headers := map[string]string{"x-api-key": "abc", "Origin": "https://dapp.example"}
+	if lambdaHeader(headers, auth.Header) != "abc" || lambdaHeader(headers, "Origin") != "https://dapp.example" {
+		t.Errorf("Failed to get header regardless of its case")
+	}
+	if lambdaHeader(headers, "Referer") != "" {
+		t.Errorf("Missing header should be blank")
+	}
+
+	if h := errorHeader(json.NewRateLimited(nil, 3)); h.Get("Retry-After") != "3" {
+		t.Errorf("Rate limited error should have Retry-After: %v", h)
+	}
+	if h := errorHeader(json.NewInternalError(nil)); h != nil {
+		t.Errorf("Unexpected header: %v", h)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := limitHandler(http.HandlerFunc(httpHandler))
+	body := `{"jsonrpc":"2.0","method":"eth_getLogs","params":[{}],"id":"logs"}`
+	weight := limiter.GetInstance().Weight("eth_getLogs")
+	if weight <= 1 {
+		t.Fatalf("eth_getLogs should cost more than others: %v", weight)
+	}
+
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < 100; i++ {
+		rec = httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.RemoteAddr = "192.0.2.1:1234"
+		if h.ServeHTTP(rec, r); rec.Code == 429 {
+			break
+		}
+	}
+	resp := json.GetRPCResponseFromJSON(rec.Body.String())
+	if rec.Code != 429 || rec.Header().Get("Retry-After") == "" || resp.Error == nil || string(resp.ID) != `"logs"` {
+		t.Fatalf("Client flooding requests should be limited: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Other clients are not affected
+	rec = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.2:1234"
+	if h.ServeHTTP(rec, r); rec.Code != 200 {
+		t.Errorf("Other client should not be limited: %d", rec.Code)
+	}
+}
+
+func TestChainRouting(t *testing.T) {
+	tests := []struct {
+		path, header string
+		chain, rest  string
+	}{
+		{"/", "", config.Testnet, "/"},
+		{"/chain/side", "", "side", "/"},
+		{"/chain/137/ws", "", "side", "/ws"},
+		{"/side/ws", rpc.Testnet, "side", "/ws"},
+		{"/ws", "137", "side", "/ws"},
+		{"/ws", rpc.Testnet, config.Testnet, "/ws"},
+		{"/testnet", "", config.Testnet, "/"},
+	}
+	for _, test := range tests {
+		r, rest, rpcErr := resolveChain(test.path, test.header)
+		if rpcErr != nil || r.NetType != test.chain || rest != test.rest {
+			t.Errorf("Unexpected chain of %s %s: %v %s %v", test.path, test.header, r, rest, rpcErr)
+		}
+	}
+	if r := rpc.Get("side"); r.NetVersion.Uint64() != 137 || rpc.GetInstance().NetVersion.Uint64() != 3 {
+		t.Errorf("Chains should have own chain ID")
+	}
+
+	rt := newRouter()
+	body := `{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`
+	statuses := map[string]int{
+		"/chain/side":    200,
+		"/chain/1":       404,
+		"/chain/unknown": 404,
+	}
+	for path, status := range statuses {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		if w.Code != status {
+			t.Errorf("Unexpected status of %s: %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	// Response names the node which served it
+	w := httptest.NewRecorder()
+	body = `{"jsonrpc":"2.0","method":"eth_getCode","params":["0x1","0x1"],"id":1}`
+	rt.ServeHTTP(w, httptest.NewRequest("POST", "/chain/side", strings.NewReader(body)))
+	if !strings.HasPrefix(w.Header().Get(UpstreamHeader), "127.0.0.1:") || w.Header().Get(UpstreamHeadHeader) == "" {
+		t.Errorf("Unexpected upstream header: %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set(ChainHeader, "unknown")
+	rt.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("Unknown chain in header should be rejected: %d", w.Code)
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	rt := newRouter()
+	body := `{"jsonrpc":"2.0","method":"eth_getCode","params":["0x1","latest"],"id":1}`
+	statuses := map[string]int{
+		"":  200,
+		"1": 200,
+		// Test node is the only node of the chain
+		"2": http.StatusBadGateway,
+		"x": http.StatusBadRequest,
+	}
+	for value, status := range statuses {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/chain/side", strings.NewReader(body))
+		req.Header.Set(QuorumHeader, value)
+		rt.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("Unexpected status of quorum %s: %d %s", value, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	serve(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`, "")
+	serve(`{"jsonrpc":"2.0","method":"personal_unlockAccount","params":[],"id":1}`, "")
+
+	w := httptest.NewRecorder()
+	metrics.GetInstance().ServeHTTP(w, httptest.NewRequest("GET", MetricsPath, nil))
+	for _, expected := range []string{
+		`eth_proxy_requests_total{chain="testnet",method="eth_blockNumber",code="0"}`,
+		`eth_proxy_requests_total{chain="testnet",method="personal_unlockAccount",code="-32004"}`,
+		`eth_proxy_request_duration_seconds_count{chain="testnet",method="eth_blockNumber"}`,
+		`eth_proxy_upstream_available{chain="testnet"} 1`,
+		`eth_proxy_upstream_requests_total{chain="testnet",upstream="127.0.0.1:`,
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Metrics should contain %s", expected)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	for _, path := range []string{HealthPath, ReadyPath} {
+		resp, _ := lambdaHandler(nil, events.APIGatewayProxyRequest{Path: path})
+		// Test node reports syncing
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(resp.Body, `"syncing":true`) {
+			t.Errorf("Unexpected %s: %d %s", path, resp.StatusCode, resp.Body)
+		}
+	}
+}
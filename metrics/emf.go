@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// emfMetadata is _aws member of CloudWatch embedded metric format
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// emfDirective tells CloudWatch which members are metrics and dimensions
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+// emfMetric is a definition of metric member
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// WriteEMF writes metrics changed since the last call in CloudWatch embedded metric format
+// A line is a series whose labels are dimensions so that Lambda logs become metrics.
+// Counters are written as increments and histograms as observed values
+// because CloudWatch aggregates lines of every Lambda instance.
+func (r *Registry) WriteEMF(w io.Writer, namespace string, now time.Time) {
+	enc := json.NewEncoder(w)
+	for _, v := range r.snapshot() {
+		v.mu.Lock()
+		for _, s := range v.sorted() {
+			var value interface{}
+			switch v.typ {
+			case counterType:
+				if s.value == s.dumped {
+					continue
+				}
+				value = s.value - s.dumped
+				s.dumped = s.value
+			case gaugeType:
+				value = s.value
+			case histogramType:
+				if len(s.pending) == 0 {
+					continue
+				}
+				value = s.pending
+				s.pending = nil
+			}
+
+			line := map[string]interface{}{
+				"_aws": emfMetadata{
+					Timestamp: now.UnixNano() / int64(time.Millisecond),
+					CloudWatchMetrics: []emfDirective{{
+						Namespace:  namespace,
+						Dimensions: [][]string{append([]string{}, v.labels...)},
+						Metrics:    []emfMetric{{Name: v.name, Unit: v.unit()}},
+					}},
+				},
+				v.name: value,
+			}
+			for i, l := range v.labels {
+				line[l] = s.values[i]
+			}
+			enc.Encode(line)
+		}
+		v.mu.Unlock()
+	}
+}
+
+// unit returns CloudWatch unit of the metric following its name and type
+func (v *Vec) unit() string {
+	switch {
+	case strings.HasSuffix(v.name, "_seconds"):
+		return "Seconds"
+	case v.typ == counterType:
+		return "Count"
+	}
+	return "None"
+}
@@ -0,0 +1,284 @@
+// Package metrics collects counters, gauges and histograms
+// and exposes them in Prometheus text format for HTTP mode
+// or in CloudWatch embedded metric format for Lambda
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Types of metric
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+const (
+	// ContentType is a content-type of Prometheus text format
+	ContentType = "text/plain; version=0.0.4"
+	// Overflow is a label value replacing every label of series over maxSeries
+	Overflow = "other"
+	// Series of a metric to bound memory against labels given by clients
+	maxSeries = 1000
+	// Observations kept for the next EMF dump, which allows 100 values a metric
+	maxPending = 100
+)
+
+// DefBuckets are upper bounds of latency histogram in second
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry keeps metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*Vec
+	// collectors update metrics from other packages before being exposed
+	collectors []func()
+}
+
+// Vec is a metric partitioned by labels
+type Vec struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is a value of Vec having label values
+type series struct {
+	values []string
+	value  float64
+	// For histogram
+	counts  []uint64
+	sum     float64
+	count   uint64
+	pending []float64
+	// value at the last EMF dump
+	dumped float64
+}
+
+// For singleton
+var (
+	instance *Registry
+	once     sync.Once
+)
+
+// GetInstance returns Registry shared by packages
+func GetInstance() *Registry {
+	once.Do(func() {
+		instance = NewRegistry()
+	})
+	return instance
+}
+
+// NewRegistry returns empty Registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*Vec)}
+}
+
+// Counter returns a counter, registering it at first
+func (r *Registry) Counter(name, help string, labels ...string) *Vec {
+	return r.register(name, help, counterType, nil, labels)
+}
+
+// Gauge returns a gauge, registering it at first
+func (r *Registry) Gauge(name, help string, labels ...string) *Vec {
+	return r.register(name, help, gaugeType, nil, labels)
+}
+
+// Histogram returns a histogram having upper bounds of buckets, registering it at first
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Vec {
+	return r.register(name, help, histogramType, buckets, labels)
+}
+
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *Vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.metrics[name]; ok {
+		if v.typ != typ || len(v.labels) != len(labels) {
+			panic("metrics: " + name + " is registered as another type")
+		}
+		return v
+	}
+	v := &Vec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.metrics[name] = v
+	return v
+}
+
+// OnCollect adds a function updating metrics before they are exposed
+// It suits values kept by other packages such as cache stats
+func (r *Registry) OnCollect(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, fn)
+}
+
+// Reset removes every series
+// It suits a gauge whose label values may disappear
+func (v *Vec) Reset() {
+	v.mu.Lock()
+	v.series = make(map[string]*series)
+	v.mu.Unlock()
+}
+
+// Add adds delta to the series having label values
+func (v *Vec) Add(delta float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value += delta
+	v.mu.Unlock()
+}
+
+// Inc adds one to the series having label values
+func (v *Vec) Inc(values ...string) {
+	v.Add(1, values...)
+}
+
+// Set sets value of the series having label values
+func (v *Vec) Set(value float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value = value
+	v.mu.Unlock()
+}
+
+// Observe adds a value to histogram series having label values
+func (v *Vec) Observe(value float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.get(values)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(v.buckets))
+	}
+	for i, b := range v.buckets {
+		if value <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+	if len(s.pending) < maxPending {
+		s.pending = append(s.pending, value)
+	}
+}
+
+// get returns the series having label values, which must be called with lock
+// Series over maxSeries are merged into one labelled Overflow
+func (v *Vec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+	if len(v.series) >= maxSeries {
+		values = make([]string, len(v.labels))
+		for i := range values {
+			values[i] = Overflow
+		}
+		key = strings.Join(values, "\xff")
+		if s, ok := v.series[key]; ok {
+			return s
+		}
+	}
+	s := &series{values: append([]string(nil), values...)}
+	v.series[key] = s
+	return s
+}
+
+// snapshot returns metrics sorted by name after running collectors
+func (r *Registry) snapshot() []*Vec {
+	r.mu.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	r.mu.Unlock()
+	for _, fn := range collectors {
+		fn()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vecs := make([]*Vec, 0, len(r.metrics))
+	for _, v := range r.metrics {
+		vecs = append(vecs, v)
+	}
+	sort.Slice(vecs, func(i, j int) bool { return vecs[i].name < vecs[j].name })
+	return vecs
+}
+
+// sorted returns series sorted by label values, which must be called with lock
+func (v *Vec) sorted() []*series {
+	ss := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		ss = append(ss, s)
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return strings.Join(ss[i].values, "\xff") < strings.Join(ss[j].values, "\xff")
+	})
+	return ss
+}
+
+// WriteText writes every metric in Prometheus text format
+func (r *Registry) WriteText(w io.Writer) {
+	for _, v := range r.snapshot() {
+		v.mu.Lock()
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+		for _, s := range v.sorted() {
+			if v.typ != histogramType {
+				fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelText(s.values, ""), formatFloat(s.value))
+				continue
+			}
+			for i, b := range v.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelText(s.values, formatFloat(b)), s.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelText(s.values, "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labelText(s.values, ""), formatFloat(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labelText(s.values, ""), s.count)
+		}
+		v.mu.Unlock()
+	}
+}
+
+// labelText returns labels in braces, le is added for histogram bucket unless blank
+func (v *Vec) labelText(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, l := range v.labels {
+		pairs = append(pairs, l+"="+strconv.Quote(values[i]))
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// ServeHTTP serves metrics in Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteText(w)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests", "method")
+	c.Inc("eth_call")
+	c.Add(2, "eth_call")
+	h := r.Histogram("duration_seconds", "Latency", []float64{0.1, 1}, "method")
+	h.Observe(0.05, "eth_call")
+	h.Observe(0.5, "eth_call")
+	g := r.Gauge("available", "Nodes")
+	r.OnCollect(func() { g.Set(3) })
+
+	if r.Counter("requests_total", "Requests", "method") != c {
+		t.Errorf("Registered metric should be returned")
+	}
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+	expected := `# HELP available Nodes
+# TYPE available gauge
+available 3
+# HELP duration_seconds Latency
+# TYPE duration_seconds histogram
+duration_seconds_bucket{method="eth_call",le="0.1"} 1
+duration_seconds_bucket{method="eth_call",le="1"} 2
+duration_seconds_bucket{method="eth_call",le="+Inf"} 2
+duration_seconds_sum{method="eth_call"} 0.55
+duration_seconds_count{method="eth_call"} 2
+# HELP requests_total Requests
+# TYPE requests_total counter
+requests_total{method="eth_call"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected text:\n%s", buf.String())
+	}
+}
+
+func TestWriteEMF(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests", "method")
+	h := r.Histogram("duration_seconds", "Latency", DefBuckets, "method")
+	c.Add(2, "eth_call")
+	h.Observe(0.5, "eth_call")
+
+	dump := func() []map[string]interface{} {
+		var buf bytes.Buffer
+		r.WriteEMF(&buf, "Test", time.Unix(1500000000, 0))
+		var lines []map[string]interface{}
+		for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if l == "" {
+				continue
+			}
+			var line map[string]interface{}
+			if err := json.Unmarshal([]byte(l), &line); err != nil {
+				t.Fatalf("Invalid line %s: %s", l, err)
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	lines := dump()
+	if len(lines) != 2 || lines[0]["duration_seconds"].([]interface{})[0] != 0.5 ||
+		lines[1]["requests_total"] != 2.0 || lines[1]["method"] != "eth_call" {
+		t.Fatalf("Unexpected EMF: %v", lines)
+	}
+	aws := fmt.Sprint(lines[1]["_aws"])
+	if !strings.Contains(aws, "Namespace:Test") || !strings.Contains(aws, "Timestamp:1.5e+12") {
+		t.Errorf("Unexpected metadata: %s", aws)
+	}
+
+	// Only changes are written
+	c.Inc("eth_call")
+	if lines = dump(); len(lines) != 1 || lines[0]["requests_total"] != 1.0 {
+		t.Errorf("Increment should be written: %v", lines)
+	}
+	if lines = dump(); len(lines) != 0 {
+		t.Errorf("Nothing should be written: %v", lines)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests", "method")
+	for i := 0; i < maxSeries+10; i++ {
+		c.Inc(fmt.Sprintf("m%d", i))
+	}
+	if len(c.series) != maxSeries+1 || c.series[Overflow].value != 10 {
+		t.Errorf("Series over the limit should be merged: %d", len(c.series))
+	}
+}
@@ -0,0 +1,223 @@
+// Package policy allows or denies JSON-RPC methods ahead of relaying them
+//
+// A rule is either an exact method name or a namespace glob such as "debug_*".
+// The most specific rule wins, exact name first and then the longest glob,
+// and deny wins over allow when both are equally specific.
+package policy
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Actions of rule
+const (
+	// Allow relays a method
+	Allow = config.Allow
+	// Deny rejects a method
+	Deny = config.Deny
+)
+
+// Policy decides whether a request is relayed or not
+type Policy struct {
+	cfg   config.Policy
+	rules []rule
+	// head returns the latest block number of the chain in ctx to resolve block tags
+	head func(ctx context.Context) (uint64, error)
+}
+
+// rule is a compiled pattern of Config
+type rule struct {
+	pattern string
+	action  string
+	// specificity is higher for more specific pattern
+	specificity int
+}
+
+// For singleton
+var (
+	instance *Policy
+	once     sync.Once
+	// mu guards instance replaced by Configure
+	mu sync.RWMutex
+)
+
+// GetInstance returns Policy of policy config, or default settings before Configure
+func GetInstance() *Policy {
+	once.Do(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if instance != nil {
+			return
+		}
+		var err error
+		if instance, err = New(config.Default().Policy); err != nil {
+			log.Panic("Failed to load policy, ", err)
+		}
+	})
+	mu.RLock()
+	defer mu.RUnlock()
+	return instance
+}
+
+// Configure replaces rules of policy keeping the function given by SetHead
+// The instance is kept when the new one cannot be made
+func Configure(cfg config.Policy) {
+	p, err := New(cfg)
+	if err != nil {
+		log.Error("Failed to configure policy, ", err)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if instance != nil {
+		p.head = instance.head
+	}
+	instance = p
+}
+
+// New validates config and returns Policy
+func New(cfg config.Policy) (*Policy, error) {
+	if cfg.Default == "" {
+		cfg.Default = Allow
+	}
+	if cfg.Default != Allow && cfg.Default != Deny {
+		return nil, fmt.Errorf("policy: invalid default action %s", cfg.Default)
+	}
+
+	p := &Policy{cfg: cfg}
+	for action, patterns := range map[string][]string{Allow: cfg.Allow, Deny: cfg.Deny} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return nil, fmt.Errorf("policy: invalid pattern %q", pattern)
+			}
+			p.rules = append(p.rules, rule{
+				pattern:     pattern,
+				action:      action,
+				specificity: specificity(pattern),
+			})
+		}
+	}
+	return p, nil
+}
+
+// SetHead sets a function returning the latest block number of the chain in ctx
+// Without it, a block range ending at a tag such as "latest" cannot be checked
+func (p *Policy) SetHead(head func(ctx context.Context) (uint64, error)) {
+	p.head = head
+}
+
+// Check returns RPCError when the request is rejected by policy
+func (p *Policy) Check(ctx context.Context, req ethjson.RPCRequest) *ethjson.RPCError {
+	if !p.Allowed(req.Method) {
+		return &ethjson.RPCError{
+			Code:    ethjson.MethodNotSupportedCode,
+			Message: fmt.Sprintf("the method %s is not available", req.Method),
+		}
+	}
+	if c, ok := p.cfg.Constraints[req.Method]; ok {
+		return p.checkConstraint(ctx, c, req.Params)
+	}
+	return nil
+}
+
+// Allowed reports whether the method is allowed
+func (p *Policy) Allowed(method string) bool {
+	action, best := p.cfg.Default, -1
+	for _, r := range p.rules {
+		if matched, _ := path.Match(r.pattern, method); !matched {
+			continue
+		}
+		if r.specificity > best || (r.specificity == best && r.action == Deny) {
+			action, best = r.action, r.specificity
+		}
+	}
+	return action == Allow
+}
+
+// checkConstraint checks filter object given as the first parameter
+func (p *Policy) checkConstraint(ctx context.Context, c config.Constraint, params []interface{}) *ethjson.RPCError {
+	if len(params) == 0 {
+		return nil
+	}
+	filter, ok := params[0].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if c.MaxAddresses > 0 {
+		if addrs, ok := filter["address"].([]interface{}); ok && len(addrs) > c.MaxAddresses {
+			return limitExceeded(fmt.Sprintf("address count exceeds %d", c.MaxAddresses))
+		}
+	}
+
+	// Block range does not matter for a single block given by hash
+	if _, ok := filter["blockHash"]; c.MaxBlockRange == 0 || ok {
+		return nil
+	}
+	if isHead(filter["fromBlock"]) && isHead(filter["toBlock"]) {
+		return nil
+	}
+	from, err := p.blockNumber(ctx, filter["fromBlock"])
+	if err != nil {
+		return ethjson.NewInvalidParams(err.Error())
+	}
+	to, err := p.blockNumber(ctx, filter["toBlock"])
+	if err != nil {
+		return ethjson.NewInvalidParams(err.Error())
+	}
+	if to > from && to-from > c.MaxBlockRange {
+		return limitExceeded(fmt.Sprintf("block range exceeds %d", c.MaxBlockRange))
+	}
+	return nil
+}
+
+// blockNumber resolves block number or tag of filter
+// Omitted block means "latest"
+func (p *Policy) blockNumber(ctx context.Context, block interface{}) (uint64, error) {
+	if isHead(block) {
+		if p.head == nil {
+			return 0, fmt.Errorf("latest block is unknown")
+		}
+		return p.head(ctx)
+	}
+	tag, _ := block.(string)
+	if tag == "earliest" {
+		return 0, nil
+	}
+	num, err := hexutil.DecodeUint64(tag)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block %v", block)
+	}
+	return num, nil
+}
+
+// isHead reports whether block means the latest one
+func isHead(block interface{}) bool {
+	if block == nil {
+		return true
+	}
+	tag, _ := block.(string)
+	return tag == "latest" || tag == "pending"
+}
+
+func limitExceeded(data string) *ethjson.RPCError {
+	return ethjson.NewRPCError(ethjson.LimitExceededCode, data)
+}
+
+// specificity scores exact name over any glob, longer literal prefix first
+func specificity(pattern string) int {
+	if i := strings.IndexAny(pattern, "*?["); i >= 0 {
+		return i
+	}
+	return 1 << 16
+}
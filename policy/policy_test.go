@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	"github.com/hexoul/aws-lambda-eth-proxy/json"
+)
+
+var testConfig = config.Policy{
+	Default: Deny,
+	Allow:   []string{"eth_*", "net_*", "web3_clientVersion", "debug_traceTransaction"},
+	Deny:    []string{"eth_sign*", "eth_sendTransaction", "debug_*"},
+	Constraints: map[string]config.Constraint{
+		"eth_getLogs": {MaxBlockRange: 100, MaxAddresses: 2},
+	},
+}
+
+func testPolicy(t *testing.T) *Policy {
+	p, err := New(testConfig)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %s", err)
+	}
+	p.SetHead(func(context.Context) (uint64, error) { return 1000, nil })
+	return p
+}
+
+func TestAllowed(t *testing.T) {
+	p := testPolicy(t)
+	tests := map[string]bool{
+		"eth_getBalance":         true,
+		"eth_sign":               false,
+		"eth_signTransaction":    false,
+		"eth_sendTransaction":    false,
+		"eth_sendRawTransaction": true,
+		"net_version":            true,
+		"web3_clientVersion":     true,
+		"web3_sha3":              false,
+		"debug_traceTransaction": true,
+		"debug_traceBlock":       false,
+		"admin_peers":            false,
+	}
+	for method, allowed := range tests {
+		if p.Allowed(method) != allowed {
+			t.Errorf("Unexpected policy for %s", method)
+		}
+	}
+}
+
+func TestDefault(t *testing.T) {
+	p, err := New(config.Default().Policy)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, method := range []string{"personal_unlockAccount", "admin_addPeer", "debug_setHead", "miner_start"} {
+		if p.Allowed(method) {
+			t.Errorf("%s should be denied by default", method)
+		}
+	}
+	if !p.Allowed("eth_blockNumber") {
+		t.Errorf("eth_blockNumber should be allowed by default")
+	}
+
+	if _, err = New(config.Policy{Default: "maybe"}); err == nil {
+		t.Errorf("Invalid default action should be rejected")
+	}
+	if _, err = New(config.Policy{Deny: []string{"eth_["}}); err == nil {
+		t.Errorf("Invalid pattern should be rejected")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	if !GetInstance().Allowed("eth_blockNumber") || GetInstance().Allowed("debug_setHead") {
+		t.Errorf("Default policy should be applied before Configure")
+	}
+	GetInstance().SetHead(func(context.Context) (uint64, error) { return 1000, nil })
+
+	Configure(testConfig)
+	if p := GetInstance(); p.Allowed("web3_sha3") || p.head == nil {
+		t.Errorf("Rules should be replaced with head kept")
+	}
+	if Configure(config.Policy{Default: "maybe"}); GetInstance().Allowed("web3_sha3") {
+		t.Errorf("Invalid policy should not replace the instance")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := testPolicy(t)
+	req := func(method string, params ...interface{}) json.RPCRequest {
+		return json.RPCRequest{Jsonrpc: "2.0", Method: method, Params: params, ID: []byte("1")}
+	}
+	filter := func(from, to interface{}) map[string]interface{} {
+		f := map[string]interface{}{}
+		if from != nil {
+			f["fromBlock"] = from
+		}
+		if to != nil {
+			f["toBlock"] = to
+		}
+		return f
+	}
+
+	tests := []struct {
+		req  json.RPCRequest
+		code int32
+	}{
+		{req("admin_peers"), json.MethodNotSupportedCode},
+		{req("eth_getLogs", filter("0x1", "0x65")), 0},
+		{req("eth_getLogs", filter("0x1", "0x66")), json.LimitExceededCode},
+		{req("eth_getLogs", filter("0x384", nil)), 0},
+		{req("eth_getLogs", filter("0x383", "latest")), json.LimitExceededCode},
+		{req("eth_getLogs", filter("earliest", "0x10")), 0},
+		{req("eth_getLogs", filter(nil, nil)), 0},
+		{req("eth_getLogs", map[string]interface{}{"blockHash": "0x1"}), 0},
+		{req("eth_getLogs", filter("abc", "0x1")), json.InvalidParamsCode},
+		{req("eth_getLogs", map[string]interface{}{"address": []interface{}{"0x1", "0x2", "0x3"}}), json.LimitExceededCode},
+		{req("eth_getBalance", "0x1", "latest"), 0},
+	}
+	for _, test := range tests {
+		err := p.Check(context.Background(), test.req)
+		if (test.code == 0 && err != nil) || (test.code != 0 && (err == nil || err.Code != test.code)) {
+			t.Errorf("Unexpected result for %s %v: %v", test.req.Method, test.req.Params, err)
+		}
+	}
+
+	p.SetHead(func(context.Context) (uint64, error) { return 0, fmt.Errorf("unknown") })
+	if err := p.Check(context.Background(), req("eth_getLogs", filter("0x1", nil))); err == nil {
+		t.Errorf("Unknown range should be rejected")
+	}
+}
@@ -2,6 +2,7 @@
 package predefined
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/hexoul/aws-lambda-eth-proxy/json"
@@ -10,44 +11,48 @@ import (
 )
 
 // Sample
-func foo(req json.RPCRequest) (json.RPCResponse, error) {
+func foo(ctx context.Context, req json.RPCRequest) (json.RPCResponse, error) {
 	fmt.Println("foo")
 	return json.RPCResponse{}, nil
 }
 
 // getBalance is a wrapper to support fromWei for eth_getBalance
-func getBalance(req json.RPCRequest) (json.RPCResponse, error) {
+// on the chain carried by ctx
+func getBalance(ctx context.Context, req json.RPCRequest) (json.RPCResponse, error) {
 	// Preprocessing
 	var unit string
 	if len(req.Params) > 2 {
-		unit = req.Params[2].(string)
+		var ok bool
+		if unit, ok = req.Params[2].(string); !ok {
+			return json.RPCResponse{}, json.NewInvalidParams("unit must be string")
+		}
 		req.Params = req.Params[:2]
 	}
 
 	// RPC
-	var resp json.RPCResponse
-	respBody, err := rpc.GetInstance().DoRPC(req)
-	if err == nil {
-		resp = json.GetRPCResponseFromJSON(respBody)
-		// Postprocessing
-		if unit != "" {
-			if val, err := web3.FromWei(resp.Result.(string), unit); err == nil {
-				resp.Result = val
-			}
-		}
+	respBody, err := rpc.FromContext(ctx).DoRPCContext(ctx, req)
+	if err != nil {
+		return json.RPCResponse{}, json.NewUpstreamError(err)
 	}
 
-	return resp, err
+	// Postprocessing
+	resp := json.GetRPCResponseFromJSON(respBody)
+	if result, ok := resp.Result.(string); ok && unit != "" {
+		if val, err := web3.FromWei(result, unit); err == nil {
+			resp.Result = val
+		}
+	}
+	return resp, nil
 }
 
 // Forward delivers RPCRequest to predefined function and returns that
-func Forward(req json.RPCRequest) (json.RPCResponse, error) {
+func Forward(ctx context.Context, req json.RPCRequest) (json.RPCResponse, error) {
 	for k, v := range predefinedPaths {
 		if k == req.Method {
-			return v.(func(json.RPCRequest) (json.RPCResponse, error))(req)
+			return v.(func(context.Context, json.RPCRequest) (json.RPCResponse, error))(ctx, req)
 		}
 	}
-	return json.RPCResponse{}, fmt.Errorf("predefined NOT FOUND")
+	return json.RPCResponse{}, json.NewMethodNotFound(req.Method)
 }
 
 // Contains check if given path is in predefined or not
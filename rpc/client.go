@@ -0,0 +1,254 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// FeeHistory is a result of eth_feeHistory
+type FeeHistory struct {
+	OldestBlock *big.Int
+	// Reward is priority fees at percentiles asked of every block
+	Reward  [][]*big.Int
+	BaseFee []*big.Int
+	// GasUsedRatio is gas used over gas limit of every block
+	GasUsedRatio []float64
+}
+
+// rpcBlock is a block having transactions and hashes of uncles
+type rpcBlock struct {
+	Hash         common.Hash          `json:"hash"`
+	Transactions []*types.Transaction `json:"transactions"`
+	UncleHashes  []common.Hash        `json:"uncles"`
+}
+
+// rpcTransaction is a transaction with block number where it is mined, nil while pending
+type rpcTransaction struct {
+	*types.Transaction
+	BlockNumber *string
+}
+
+func (tx *rpcTransaction) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &tx.Transaction); err != nil {
+		return err
+	}
+	var extra struct {
+		BlockNumber *string `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(b, &extra); err != nil {
+		return err
+	}
+	tx.BlockNumber = extra.BlockNumber
+	return nil
+}
+
+// callResult invokes RPC through upstream selection and retry of the chain
+// and decodes its result into result
+// It returns error of JSON-RPC response as it is, and ethereum.NotFound for null result.
+func (r *RPC) callResult(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+	req := initRPCRequest(method)
+	req.Params = params
+	respBody, err := r.DoRPCContext(ctx, req)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Result json.RawMessage   `json:"result"`
+		Error  *ethjson.RPCError `json:"error"`
+	}
+	if err = json.Unmarshal([]byte(respBody), &resp); err != nil {
+		return fmt.Errorf("invalid response of %s: %s", method, err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if len(resp.Result) == 0 || string(resp.Result) == "null" {
+		return ethereum.NotFound
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// BlockNumber returns the latest block number
+func (r *RPC) BlockNumber(ctx context.Context) (uint64, error) {
+	var number hexutil.Uint64
+	err := r.callResult(ctx, &number, "eth_blockNumber")
+	return uint64(number), err
+}
+
+// GetBlockByNumber returns the block having transactions, or the latest block for nil number
+func (r *RPC) GetBlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	return r.getBlock(ctx, "eth_getBlockByNumber", toBlockNumArg(number), true)
+}
+
+// GetBlockByHash returns the block having transactions
+func (r *RPC) GetBlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	return r.getBlock(ctx, "eth_getBlockByHash", hash.Hex(), true)
+}
+
+// getBlock returns the block of header and transactions in the response with uncles fetched again
+func (r *RPC) getBlock(ctx context.Context, method string, params ...interface{}) (*types.Block, error) {
+	var raw json.RawMessage
+	if err := r.callResult(ctx, &raw, method, params...); err != nil {
+		return nil, err
+	}
+	var head *types.Header
+	var body rpcBlock
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, err
+	}
+	uncles := make([]*types.Header, len(body.UncleHashes))
+	for i := range uncles {
+		if err := r.callResult(ctx, &uncles[i], "eth_getUncleByBlockHashAndIndex", body.Hash.Hex(), hexutil.EncodeUint64(uint64(i))); err != nil {
+			return nil, err
+		}
+	}
+	return types.NewBlockWithHeader(head).WithBody(body.Transactions, uncles), nil
+}
+
+// GetTransactionByHash returns the transaction and whether it is pending
+func (r *RPC) GetTransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error) {
+	var result rpcTransaction
+	if err = r.callResult(ctx, &result, "eth_getTransactionByHash", hash.Hex()); err != nil {
+		return nil, false, err
+	}
+	return result.Transaction, result.BlockNumber == nil, nil
+}
+
+// GetTransactionReceipt returns the receipt of mined transaction
+func (r *RPC) GetTransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	var receipt *types.Receipt
+	err := r.callResult(ctx, &receipt, "eth_getTransactionReceipt", hash.Hex())
+	return receipt, err
+}
+
+// EstimateGas returns gas which the call needs to be mined at the latest block
+func (r *RPC) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	var gas hexutil.Uint64
+	err := r.callResult(ctx, &gas, "eth_estimateGas", toCallArg(msg))
+	return uint64(gas), err
+}
+
+// GetLogs returns logs matching the filter
+func (r *RPC) GetLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	arg, err := toFilterArg(q)
+	if err != nil {
+		return nil, err
+	}
+	var logs []types.Log
+	if err = r.callResult(ctx, &logs, "eth_getLogs", arg); err == ethereum.NotFound {
+		err = nil
+	}
+	return logs, err
+}
+
+// GetBalance returns wei of the account at the block, or at the latest block for nil number
+func (r *RPC) GetBalance(ctx context.Context, account common.Address, number *big.Int) (*big.Int, error) {
+	var balance hexutil.Big
+	if err := r.callResult(ctx, &balance, "eth_getBalance", account.Hex(), toBlockNumArg(number)); err != nil {
+		return nil, err
+	}
+	return (*big.Int)(&balance), nil
+}
+
+// GetStorageAt returns value of the storage key of the account at the block,
+// or at the latest block for nil number
+func (r *RPC) GetStorageAt(ctx context.Context, account common.Address, key common.Hash, number *big.Int) ([]byte, error) {
+	var value hexutil.Bytes
+	err := r.callResult(ctx, &value, "eth_getStorageAt", account.Hex(), key.Hex(), toBlockNumArg(number))
+	return value, err
+}
+
+// FeeHistory returns fees of blockCount blocks up to lastBlock, or up to the latest block for nil lastBlock
+// with priority fees at rewardPercentiles of every block
+func (r *RPC) FeeHistory(ctx context.Context, blockCount uint64, lastBlock *big.Int, rewardPercentiles []float64) (*FeeHistory, error) {
+	var result struct {
+		OldestBlock  *hexutil.Big     `json:"oldestBlock"`
+		Reward       [][]*hexutil.Big `json:"reward"`
+		BaseFee      []*hexutil.Big   `json:"baseFeePerGas"`
+		GasUsedRatio []float64        `json:"gasUsedRatio"`
+	}
+	if err := r.callResult(ctx, &result, "eth_feeHistory", hexutil.EncodeUint64(blockCount), toBlockNumArg(lastBlock), rewardPercentiles); err != nil {
+		return nil, err
+	}
+	h := &FeeHistory{
+		OldestBlock:  (*big.Int)(result.OldestBlock),
+		Reward:       make([][]*big.Int, len(result.Reward)),
+		BaseFee:      make([]*big.Int, len(result.BaseFee)),
+		GasUsedRatio: result.GasUsedRatio,
+	}
+	for i, rewards := range result.Reward {
+		h.Reward[i] = make([]*big.Int, len(rewards))
+		for j, reward := range rewards {
+			h.Reward[i][j] = (*big.Int)(reward)
+		}
+	}
+	for i, fee := range result.BaseFee {
+		h.BaseFee[i] = (*big.Int)(fee)
+	}
+	return h, nil
+}
+
+// toBlockNumArg returns block parameter of number, nil means the latest block
+func toBlockNumArg(number *big.Int) string {
+	if number == nil {
+		return "latest"
+	}
+	return hexutil.EncodeBig(number)
+}
+
+// toCallArg returns call object of the message
+func toCallArg(msg ethereum.CallMsg) map[string]interface{} {
+	arg := map[string]interface{}{
+		"from": msg.From.Hex(),
+	}
+	if msg.To != nil {
+		arg["to"] = msg.To.Hex()
+	}
+	if len(msg.Data) > 0 {
+		arg["data"] = hexutil.Encode(msg.Data)
+	}
+	if msg.Value != nil {
+		arg["value"] = hexutil.EncodeBig(msg.Value)
+	}
+	if msg.Gas != 0 {
+		arg["gas"] = hexutil.EncodeUint64(msg.Gas)
+	}
+	if msg.GasPrice != nil {
+		arg["gasPrice"] = hexutil.EncodeBig(msg.GasPrice)
+	}
+	return arg
+}
+
+// toFilterArg returns filter object of the query
+// Block numbers are given as strings so that the filter is routed by them
+func toFilterArg(q ethereum.FilterQuery) (map[string]interface{}, error) {
+	arg := map[string]interface{}{
+		"address": q.Addresses,
+		"topics":  q.Topics,
+	}
+	if q.BlockHash != nil {
+		if q.FromBlock != nil || q.ToBlock != nil {
+			return nil, fmt.Errorf("cannot specify both BlockHash and FromBlock/ToBlock")
+		}
+		arg["blockHash"] = q.BlockHash.Hex()
+		return arg, nil
+	}
+	arg["fromBlock"] = "0x0"
+	if q.FromBlock != nil {
+		arg["fromBlock"] = toBlockNumArg(q.FromBlock)
+	}
+	arg["toBlock"] = toBlockNumArg(q.ToBlock)
+	return arg, nil
+}
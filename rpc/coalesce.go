@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+)
+
+// call is an upstream call in flight shared by identical requests
+type call struct {
+	done  chan struct{}
+	resp  string
+	route Route
+	err   error
+
+	// waiters is the number of callers waiting for the call,
+	// which is cancelled when every caller gives up
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// group coalesces identical calls in flight into one
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// do invokes fn once for concurrent calls having the same key
+// and gives its result to every caller
+// A caller returns with error of ctx when it is done before the call,
+// but the call goes on until every caller is done
+// shared is true for callers which waited for a call of another
+func (g *group) do(ctx context.Context, key string, fn func(ctx context.Context) (string, Route, error)) (resp string, route Route, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.Background())
+		c = &call{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			c.resp, c.route, c.err = fn(callCtx)
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.resp, c.route, c.err, shared
+	case <-ctx.Done():
+	}
+	g.mu.Lock()
+	if c.waiters--; c.waiters == 0 {
+		// Nobody waits for the call, which is not to be joined either
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		c.cancel()
+	}
+	g.mu.Unlock()
+	return "", Route{}, ctx.Err(), shared
+}
@@ -0,0 +1,141 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// NodeStatus is a state of a node probed directly
+type NodeStatus struct {
+	// URL has scheme and host only not to expose credentials in path
+	URL       string `json:"url"`
+	Reachable bool   `json:"reachable"`
+	Syncing   bool   `json:"syncing"`
+	// BlockNumber is the latest block of the node
+	BlockNumber uint64 `json:"blockNumber"`
+	// Lag is blocks behind the best node of the chain
+	Lag   uint64 `json:"lag"`
+	Error string `json:"error,omitempty"`
+}
+
+// Route is a node which served a request with its head block at the time
+type Route struct {
+	// Node is a host not to expose credentials in URL
+	Node string
+	// Head is zero when it is not polled yet
+	Head uint64
+}
+
+// Healthy reports whether the node can serve requests
+func (s NodeStatus) Healthy() bool {
+	return s.Reachable && !s.Syncing
+}
+
+// CheckNodes probes every node of the chain regardless of failures in the past
+// Nodes are probed at once and their statuses keep the order of urls
+func (r *RPC) CheckNodes(ctx context.Context) []NodeStatus {
+	r.mu.RLock()
+	urls := make([]string, len(r.upstreams))
+	clients := make([]*http.Client, len(r.upstreams))
+	for i, up := range r.upstreams {
+		urls[i], clients[i] = up.URL, r.clientOf(up.URL)
+	}
+	r.mu.RUnlock()
+
+	statuses := make([]NodeStatus, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			statuses[i] = checkNode(ctx, clients[i], u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	var best uint64
+	for _, s := range statuses {
+		if s.Reachable && s.BlockNumber > best {
+			best = s.BlockNumber
+		}
+	}
+	for i := range statuses {
+		if statuses[i].Reachable {
+			statuses[i].Lag = best - statuses[i].BlockNumber
+		}
+	}
+	return statuses
+}
+
+// checkNode returns a status of the node from eth_syncing and eth_blockNumber
+func checkNode(ctx context.Context, client *http.Client, rawurl string) (s NodeStatus) {
+	s.URL = rawurl
+	if u, err := url.Parse(rawurl); err == nil {
+		s.URL = u.Scheme + "://" + u.Host
+		if u.Scheme == "unix" {
+			s.URL += u.Path
+		}
+	}
+
+	// eth_syncing returns false or an object describing progress
+	syncing, err := callNode(ctx, client, rawurl, "eth_syncing")
+	if err != nil {
+		s.Error = err.Error()
+		return
+	}
+	s.Reachable = true
+	s.Syncing = string(syncing) != "false"
+
+	number, err := callNode(ctx, client, rawurl, "eth_blockNumber")
+	if err == nil {
+		var n hexutil.Uint64
+		if err = json.Unmarshal(number, &n); err == nil {
+			s.BlockNumber = uint64(n)
+		}
+	}
+	if err != nil {
+		s.Reachable = false
+		s.Error = err.Error()
+	}
+	return
+}
+
+// callNode invokes RPC without params to the node and returns its result
+func callNode(ctx context.Context, client *http.Client, rawurl, method string) (json.RawMessage, error) {
+	body, _ := json.Marshal(initRPCRequest(method))
+	req, err := http.NewRequest("POST", rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		// Error having URL may expose credentials in it
+		if urlErr, ok := err.(*url.Error); ok {
+			return nil, urlErr.Err
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ret struct {
+		Result json.RawMessage   `json:"result"`
+		Error  *ethjson.RPCError `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("invalid response of %s: %s", method, err)
+	}
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+	return ret.Result, nil
+}
@@ -0,0 +1,501 @@
+package rpc
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+)
+
+const (
+	// latencyWeight is a weight of the latest sample in average latency of a node
+	latencyWeight = 0.2
+	// failureSlack tolerates failures decayed slightly between failures in a row
+	failureSlack = 0.01
+	// maxSamples is the number of the latest latencies kept for percentile
+	maxSamples = 256
+	// minSamples is the number of latencies needed for percentile to be meaningful
+	minSamples = 20
+)
+
+// breakerState is a state of circuit breaker of a node
+type breakerState int
+
+// States of circuit breaker
+const (
+	// closed node serves requests
+	closed breakerState = iota
+	// open node is excluded until cooldown passes
+	open
+	// halfOpen node is being probed to be closed again
+	halfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case open:
+		return "open"
+	case halfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// node is an Ether node with its circuit breaker
+type node struct {
+	url   string
+	state breakerState
+	// failures decays by half every half-life of pool
+	failures float64
+	updated  time.Time
+	openedAt time.Time
+
+	weight int
+	// current is a credit of smooth weighted round-robin
+	current int
+	// latency is an exponentially weighted moving average in second, zero before sampled
+	latency  float64
+	inflight int
+	// head is the latest block of the node, zero before polled
+	head uint64
+	// archive node keeps state of every block
+	archive bool
+}
+
+// pool is a set of nodes excluding failing ones by circuit breakers
+// Failures of a node open its breaker when they reach threshold,
+// and the node is probed in background after cooldown to be closed again.
+// Heads of nodes are polled in background to exclude nodes lagging behind.
+type pool struct {
+	threshold    float64
+	cooldown     time.Duration
+	maxLag       uint64
+	archiveDepth uint64
+	headInterval time.Duration
+	now          func() time.Time
+	strategy     strategy
+
+	mu    sync.Mutex
+	nodes []*node
+	// next is a turn of round-robin
+	next int
+	// samples are latencies of the latest requests served regardless of node
+	samples []time.Duration
+	sampled int
+	stop    chan struct{}
+}
+
+// newPool returns pool of upstreams of the chain
+// States of nodes in prev are kept for the same url
+func newPool(chain config.Chain, settings config.RPC, prev *pool) *pool {
+	p := &pool{
+		threshold:    float64(settings.FailThreshold),
+		cooldown:     time.Duration(settings.Cooldown) * time.Second,
+		maxLag:       uint64(settings.MaxLag),
+		archiveDepth: uint64(settings.ArchiveDepth),
+		headInterval: time.Duration(settings.HeadInterval) * time.Second,
+		now:          time.Now,
+		strategy:     strategies[chain.Strategy],
+		stop:         make(chan struct{}),
+	}
+	if p.strategy == nil {
+		p.strategy = strategies[config.Random]
+	}
+	// States are copied with lock since requests in flight on prev update them
+	kept := make(map[string]node)
+	if prev != nil {
+		prev.mu.Lock()
+		for _, n := range prev.nodes {
+			kept[n.url] = node{
+				state:    n.state,
+				failures: n.failures,
+				updated:  n.updated,
+				openedAt: n.openedAt,
+				latency:  n.latency,
+				head:     n.head,
+			}
+		}
+		p.samples, p.sampled = append([]time.Duration(nil), prev.samples...), prev.sampled
+		prev.mu.Unlock()
+	}
+	for _, up := range chain.AllUpstreams() {
+		n := &node{url: up.URL, updated: p.now()}
+		if k, ok := kept[up.URL]; ok {
+			// Requests in flight are reported to prev
+			*n = k
+			n.url = up.URL
+		}
+		n.weight = 1
+		if up.Weight > 0 {
+			n.weight = up.Weight
+		}
+		n.archive = up.Archive
+		p.nodes = append(p.nodes, n)
+	}
+	return p
+}
+
+// pick returns a closed node chosen by strategy
+// Nodes more than maxLag blocks behind the best one are excluded,
+// and only nodes having block are picked when it is given explicitly.
+// When no node has the block, the node having the highest head is returned.
+// When every node is excluded by breakers, the node having the least failures is returned
+// not to stop serving. Nodes in exclude are never returned.
+// It returns nil without node.
+func (p *pool) pick(block uint64, exclude ...*node) *node {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pickLocked(block, exclude)
+}
+
+// acquire returns a node as pick does and counts a request in flight to it
+// The request must be done by release
+func (p *pool) acquire(block uint64, exclude ...*node) *node {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := p.pickLocked(block, exclude)
+	if n != nil {
+		n.inflight++
+	}
+	return n
+}
+
+// release finishes a request to the node started by acquire
+func (p *pool) release(n *node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n.inflight--
+}
+
+func (p *pool) pickLocked(block uint64, exclude []*node) *node {
+	nodes := make([]*node, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		if !contains(exclude, n) {
+			nodes = append(nodes, n)
+		}
+	}
+	var highest *node
+	for _, n := range nodes {
+		if n.state == closed && (highest == nil || n.head > highest.head) {
+			highest = n
+		}
+	}
+	// Head unknown yet does not exclude the node
+	avail := make([]*node, 0, len(nodes))
+	for _, n := range nodes {
+		switch {
+		case n.state != closed:
+		case n.head == 0:
+			avail = append(avail, n)
+		case block > 0:
+			// Lagging node serves a block it has
+			if n.head >= block {
+				avail = append(avail, n)
+			}
+		case n.head+p.maxLag >= highest.head:
+			avail = append(avail, n)
+		}
+	}
+	if len(avail) > 0 {
+		return p.strategy(p, avail)
+	}
+	if highest != nil {
+		return highest
+	}
+
+	// Fallback
+	var best *node
+	now := p.now()
+	for _, n := range nodes {
+		p.decay(n, now)
+		if best == nil || n.failures < best.failures {
+			best = n
+		}
+	}
+	return best
+}
+
+// contains reports whether n is in nodes
+func contains(nodes []*node, n *node) bool {
+	for _, m := range nodes {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
+
+// historical reports whether state of the block is older than full nodes keep
+// It is false when head is not polled yet or the pool has no archive node.
+func (p *pool) historical(block uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var head uint64
+	archive := false
+	for _, n := range p.nodes {
+		if n.head > head {
+			head = n.head
+		}
+		archive = archive || n.archive
+	}
+	return archive && block+p.archiveDepth < head
+}
+
+// fullNodes returns nodes not archive, which are excluded for historical state
+// Its capacity is its length so that appending to it copies.
+func (p *pool) fullNodes() []*node {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var nodes []*node
+	for _, n := range p.nodes {
+		if !n.archive {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes[:len(nodes):len(nodes)]
+}
+
+// sample records latency of a request served
+func (p *pool) sample(elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.samples) < maxSamples {
+		p.samples = append(p.samples, elapsed)
+	} else {
+		p.samples[p.sampled%maxSamples] = elapsed
+	}
+	p.sampled++
+}
+
+// percentile returns q-th percentile of latencies sampled
+// It is false until enough latencies are sampled
+func (p *pool) percentile(q float64) (time.Duration, bool) {
+	p.mu.Lock()
+	sorted := append([]time.Duration(nil), p.samples...)
+	p.mu.Unlock()
+	if len(sorted) < minSamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(q/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i], true
+}
+
+// report records a result of request to the node taking elapsed time
+func (p *pool) report(n *node, elapsed time.Duration, err error) {
+	if err != nil {
+		p.failure(n)
+		return
+	}
+	p.success(n, elapsed)
+}
+
+// success closes breaker of the node and updates its latency
+func (p *pool) success(n *node, elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.decay(n, p.now())
+	if n.latency == 0 {
+		n.latency = elapsed.Seconds()
+	} else {
+		n.latency += latencyWeight * (elapsed.Seconds() - n.latency)
+	}
+	if n.state != closed {
+		log.Info("rpc: node recovered, ", upstreamLabel(n.url))
+		n.state, n.failures = closed, 0
+	}
+}
+
+// setHead updates head block of the node
+func (p *pool) setHead(n *node, head uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n.head = head
+}
+
+// route returns Route of the node
+func (p *pool) route(n *node) Route {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Route{Node: upstreamLabel(n.url), Head: n.head}
+}
+
+// failure counts a failure of the node and opens its breaker at threshold
+// Failure of half-open node opens it again at once
+func (p *pool) failure(n *node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	p.decay(n, now)
+	n.failures++
+	if (n.state == closed && n.failures+failureSlack >= p.threshold) || n.state == halfOpen {
+		if n.state == closed {
+			log.Warn("rpc: node excluded, ", upstreamLabel(n.url))
+		}
+		n.state, n.openedAt = open, now
+	}
+}
+
+// decay halves failures every cooldown, which must be called with lock
+func (p *pool) decay(n *node, now time.Time) {
+	if elapsed := now.Sub(n.updated); elapsed > 0 && p.cooldown > 0 {
+		n.failures *= math.Pow(0.5, float64(elapsed)/float64(p.cooldown))
+	}
+	n.updated = now
+}
+
+// due turns open nodes past cooldown into half-open and returns them to be probed
+func (p *pool) due() []*node {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	var nodes []*node
+	for _, n := range p.nodes {
+		if n.state == open && now.Sub(n.openedAt) >= p.cooldown {
+			n.state = halfOpen
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// available returns the number of closed nodes
+func (p *pool) available() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cnt := 0
+	for _, n := range p.nodes {
+		if n.state == closed {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// run probes nodes due and polls heads of closed nodes in background until close
+// probe returns head block of the node
+func (p *pool) run(probe func(url string) (uint64, error)) {
+	interval := p.cooldown / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var poll <-chan time.Time
+	if p.headInterval > 0 {
+		headTicker := time.NewTicker(p.headInterval)
+		defer headTicker.Stop()
+		poll = headTicker.C
+	}
+	for {
+		select {
+		case <-ticker.C:
+			p.probe(p.due(), probe)
+		case <-poll:
+			p.probe(p.closed(), probe)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// probe probes nodes at once and records their results and heads
+func (p *pool) probe(nodes []*node, probe func(url string) (uint64, error)) {
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			start := p.now()
+			head, err := probe(n.url)
+			p.report(n, p.now().Sub(start), err)
+			if err == nil {
+				p.setHead(n, head)
+			}
+		}(n)
+	}
+	wg.Wait()
+}
+
+// closed returns closed nodes
+func (p *pool) closed() []*node {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var nodes []*node
+	for _, n := range p.nodes {
+		if n.state == closed {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// close stops probing
+func (p *pool) close() {
+	close(p.stop)
+}
+
+// strategy chooses a node among closed ones, which is called with lock
+type strategy func(p *pool, nodes []*node) *node
+
+// strategies are strategy name => strategy
+var strategies = map[string]strategy{
+	config.Random:        random,
+	config.RoundRobin:    roundRobin,
+	config.Weighted:      weighted,
+	config.LeastLatency:  leastLatency,
+	config.LeastInFlight: leastInFlight,
+}
+
+func random(p *pool, nodes []*node) *node {
+	return nodes[rand.Intn(len(nodes))]
+}
+
+func roundRobin(p *pool, nodes []*node) *node {
+	p.next++
+	return nodes[p.next%len(nodes)]
+}
+
+// weighted is smooth weighted round-robin not to send requests to a heavy node in a row
+func weighted(p *pool, nodes []*node) *node {
+	var best *node
+	total := 0
+	for _, n := range nodes {
+		n.current += n.weight
+		total += n.weight
+		if best == nil || n.current > best.current {
+			best = n
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// leastLatency prefers a node not sampled yet to measure every node
+func leastLatency(p *pool, nodes []*node) *node {
+	return least(p, nodes, func(n *node) float64 { return n.latency })
+}
+
+func leastInFlight(p *pool, nodes []*node) *node {
+	return least(p, nodes, func(n *node) float64 { return float64(n.inflight) })
+}
+
+// least returns a node having the least value, ties are broken by round-robin
+func least(p *pool, nodes []*node, value func(*node) float64) *node {
+	p.next++
+	var best *node
+	for i := range nodes {
+		n := nodes[(p.next+i)%len(nodes)]
+		if best == nil || value(n) < value(best) {
+			best = n
+		}
+	}
+	return best
+}
@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+)
+
+// answer is a response of a node asked for quorum
+type answer struct {
+	route Route
+	resp  string
+	// key is a normalized response to be compared, blank when the request failed
+	key string
+	err error
+}
+
+// Quorum returns the number of nodes to agree on a read of the method
+// It is zero when the method is not read by quorum
+func (r *RPC) Quorum(method string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !ethjson.IsIdempotent(method) {
+		return 0
+	}
+	for _, pattern := range r.settings.QuorumMethods {
+		if matched, _ := path.Match(pattern, method); matched {
+			return r.settings.Quorum
+		}
+	}
+	return 0
+}
+
+// DoRPCQuorum sends a read to n nodes at once and returns the response
+// which the majority of n agree on with Routes of the agreeing nodes
+// Responses are compared after normalization, and nodes answering differently are logged.
+// A request of non-idempotent method is not sent to several nodes but served as DoRPCRoute does.
+func (r *RPC) DoRPCQuorum(req ethjson.RPCRequest, n int) (string, []Route, error) {
+	return r.DoRPCQuorumContext(context.Background(), req, n)
+}
+
+// DoRPCQuorumContext reads by quorum as DoRPCQuorum does until ctx is done
+func (r *RPC) DoRPCQuorumContext(ctx context.Context, req ethjson.RPCRequest, n int) (string, []Route, error) {
+	if !ethjson.IsIdempotent(req.Method) || n < 2 {
+		ret, route, err := r.DoRPCRouteContext(ctx, req)
+		return ret, []Route{route}, err
+	}
+	marshal, err := json.Marshal(req)
+	if err != nil {
+		return "", nil, err
+	}
+	msg := string(marshal)
+	block, _ := ethjson.BlockNumber(req)
+	need := n/2 + 1
+
+	p := r.getPool()
+	if p == nil {
+		return "", nil, fmt.Errorf("no node of %s", r.NetType)
+	}
+	full := historyExclude(p, req)
+	var nodes []*node
+	for len(nodes) < n {
+		nd := p.acquire(block, append(full, nodes...)...)
+		if nd == nil {
+			break
+		}
+		nodes = append(nodes, nd)
+	}
+	if len(nodes) < need {
+		for _, nd := range nodes {
+			p.release(nd)
+		}
+		return "", nil, ethjson.NewRPCError(ethjson.QuorumNotReachedCode, fmt.Sprintf("%d nodes of %d needed are available", len(nodes), need))
+	}
+
+	except := append(full, nodes...)
+	answers := make([]answer, len(nodes))
+	var wg sync.WaitGroup
+	for i, nd := range nodes {
+		wg.Add(1)
+		go func(i int, nd *node) {
+			defer wg.Done()
+			defer p.release(nd)
+			var a answer
+			a.resp, a.route, a.err = r.send(ctx, p, nd, block, req.Method, msg, except...)
+			if a.err == nil {
+				a.key, a.err = normalize(a.resp)
+			}
+			answers[i] = a
+		}(i, nd)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return "", nil, ctx.Err()
+	}
+
+	// Majority
+	counts := make(map[string]int)
+	var best string
+	for _, a := range answers {
+		if a.err != nil {
+			continue
+		}
+		if counts[a.key]++; counts[a.key] > counts[best] {
+			best = a.key
+		}
+	}
+	agreed := counts[best]
+	var ret string
+	var routes []Route
+	for _, a := range answers {
+		switch {
+		case a.err != nil:
+			log.Warnf("rpc: %s failed to answer %s for quorum, %s", a.route.Node, req.Method, a.err)
+		case a.key != best:
+			log.Warnf("rpc: %s diverged from the majority on %s", a.route.Node, req.Method)
+			upstreamDivergences.Inc(r.NetType, a.route.Node)
+		default:
+			if ret == "" {
+				ret = a.resp
+			}
+			routes = append(routes, a.route)
+		}
+	}
+	if agreed < need {
+		log.Warnf("rpc: no quorum on %s, %d of %d nodes agreed", req.Method, agreed, len(nodes))
+		return "", nil, ethjson.NewRPCError(ethjson.QuorumNotReachedCode, fmt.Sprintf("%d of %d nodes agreed", agreed, n))
+	}
+	return ret, routes, nil
+}
+
+// normalize returns a response comparable across nodes regardless of id, key order and case of hex
+// Error responses are compared by code only since messages vary among clients
+func normalize(resp string) (string, error) {
+	var r struct {
+		Result interface{}       `json:"result"`
+		Error  *ethjson.RPCError `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(resp), &r); err != nil {
+		return "", fmt.Errorf("invalid response: %s", err)
+	}
+	if r.Error != nil {
+		return fmt.Sprintf("error:%d", r.Error.Code), nil
+	}
+	b, err := json.Marshal(lowerHex(r.Result))
+	return string(b), err
+}
+
+// lowerHex returns v whose hex strings are in lower case
+// Keys of maps need not be sorted since json.Marshal does
+func lowerHex(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		if strings.HasPrefix(t, "0x") || strings.HasPrefix(t, "0X") {
+			return strings.ToLower(t)
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = lowerHex(t[i])
+		}
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = lowerHex(t[k])
+		}
+	}
+	return v
+}
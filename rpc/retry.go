@@ -0,0 +1,174 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+)
+
+// maxBackoff caps time to wait before a retry
+const maxBackoff = 2 * time.Second
+
+// retryPolicy is when a request of a method may be sent again
+type retryPolicy int
+
+// Retry policies
+const (
+	// retryUndelivered retries only a request which did not reach node,
+	// such as a transaction signed by node which would be sent twice otherwise
+	retryUndelivered retryPolicy = iota
+	// retrySigned retries a signed transaction rejected or lost by node,
+	// which is safe to broadcast again because its hash and nonce do not change
+	retrySigned
+	// retryTransient retries an idempotent request failing for any transient reason
+	retryTransient
+)
+
+// transientErrors are messages of JSON-RPC errors which another node or a later attempt may not have
+var transientErrors = []string{
+	"header not found",
+	"timeout",
+	"timed out",
+	"too many requests",
+	"rate limit",
+	"busy",
+	"try again",
+	"temporarily unavailable",
+}
+
+// missingStateErrors are messages of JSON-RPC errors of a node not having state of the block,
+// which an archive node may have
+var missingStateErrors = []string{
+	"missing trie node",
+	"historical state",
+	"state is not available",
+	"state not available",
+}
+
+// policyOf returns retry policy of the method
+// A request whose method is unknown is never sent twice
+func policyOf(method string) retryPolicy {
+	switch {
+	case method == "":
+		return retryUndelivered
+	case method == "eth_sendRawTransaction":
+		return retrySigned
+	case ethjson.IsIdempotent(method):
+		return retryTransient
+	}
+	return retryUndelivered
+}
+
+// attempt is a result of a request sent to a node
+type attempt struct {
+	status int
+	body   []byte
+	err    error
+}
+
+// retryable reports whether the attempt may be sent again under the policy
+func (a attempt) retryable(policy retryPolicy) bool {
+	if a.err != nil && undelivered(a.err) {
+		return true
+	}
+	switch policy {
+	case retrySigned:
+		return a.err != nil || a.throttled()
+	case retryTransient:
+		return a.err != nil || a.throttled() || transient(a.body)
+	}
+	return false
+}
+
+// fault returns error of the node failing the request, nil when it served
+func (a attempt) fault() error {
+	switch {
+	case a.err != nil:
+		return a.err
+	case a.throttled():
+		return fmt.Errorf("node responded %d", a.status)
+	case transient(a.body):
+		return fmt.Errorf("node failed transiently")
+	}
+	return nil
+}
+
+// throttled reports whether node refused or failed the request by HTTP status
+func (a attempt) throttled() bool {
+	return a.status == http.StatusTooManyRequests || a.status >= http.StatusInternalServerError
+}
+
+// undelivered reports whether the request failed before it was written to node
+func undelivered(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	e, ok := err.(*net.OpError)
+	return ok && e.Op == "dial"
+}
+
+// rpcError returns error of JSON-RPC response, nil when body is not an error response
+func rpcError(body []byte) *ethjson.RPCError {
+	var resp struct {
+		Error *ethjson.RPCError `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return nil
+	}
+	return resp.Error
+}
+
+// transient reports whether body is a JSON-RPC error having a transient message
+func transient(body []byte) bool {
+	return hasError(body, transientErrors)
+}
+
+// missingState reports whether body is a JSON-RPC error of state missing in node
+func missingState(body []byte) bool {
+	return hasError(body, missingStateErrors)
+}
+
+// hasError reports whether body is a JSON-RPC error whose message has one of msgs
+func hasError(body []byte, msgs []string) bool {
+	e := rpcError(body)
+	if e == nil {
+		return false
+	}
+	msg := strings.ToLower(e.Message)
+	for _, s := range msgs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff waits before i-th retry for base doubled every retry with jitter
+// It returns false when ctx is done in the meantime
+func backoff(ctx context.Context, base time.Duration, i int) bool {
+	if base <= 0 {
+		return ctx.Err() == nil
+	}
+	d := base << uint(i-1)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	// Equal jitter keeps at least half of delay not to retry at once
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
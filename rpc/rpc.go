@@ -2,7 +2,7 @@
 package rpc
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,23 +10,46 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hexoul/aws-lambda-eth-proxy/common"
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
 	"github.com/hexoul/aws-lambda-eth-proxy/crypto"
 	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+	"github.com/hexoul/aws-lambda-eth-proxy/metrics"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
 )
 
 // RPC is a JSON-RPC manager through HTTP
+// There is an instance per chain, each of which has its own node pool
 type RPC struct {
 	NetType    string
 	NetVersion *big.Int
 	client     *http.Client
 	GasPrice   uint64
+
+	// mu guards node pool below, clients and settings
+	mu        sync.RWMutex
+	settings  config.RPC
+	upstreams []config.Upstream
+	// wsUpstreams serve subscriptions
+	wsUpstreams []config.Upstream
+	pool        *pool
+	// URL => HTTP client applying settings of the upstream
+	clients map[string]*http.Client
+	// URL => ethclient
+	ethClients map[string]*ethclient.Client
+
+	// inflight coalesces identical requests in flight
+	inflight group
 }
 
 const (
@@ -36,118 +59,334 @@ const (
 	Testnet = "TEST"
 	// For initial request
 	initParamJsonrpc = "2.0"
-	initParamID      = 1
-	// Threshold to classify nodes
-	threshold = 10
-	// RPC retry count
-	retryCnt = 3
-	// HTTP timeout
-	httpTimeout = 5
+	initParamID      = "1"
 )
 
 var (
-	zero = big.NewInt(0)
-	// For singleton
-	instance *RPC
-	once     sync.Once
-	// IP => ethclient
-	ethClients = make(map[string]*ethclient.Client)
-	// IP => http fail count
-	httpFailCnt = make(map[string]int)
-	// NetType => available length of IP list
-	availLen = make(map[string]int)
-	// NetType is either mainnet or testnet
+	// NetType is a name of default chain, where Mainnet and Testnet mean mainnet and testnet of config
 	NetType = Testnet
+
+	// registry is chain name => RPC
+	registry   = make(map[string]*RPC)
+	registryMu sync.RWMutex
+	// configured is true after Configure, which stops making chains implicitly
+	configured bool
 )
 
-// GetInstance returns the instance of RPC
-func GetInstance() *RPC {
-	once.Do(func() {
-		instance = &RPC{}
-		instance.InitClient()
-		availLen[Mainnet] = len(MainnetUrls)
-		availLen[Testnet] = len(TestnetUrls)
-
-		instance.NetType = NetType
-		instance.NetVersion = instance.GetChainID()
-		instance.GasPrice = instance.GetGasPrice()
-
-		if c := crypto.GetInstance(); c != nil {
-			c.InitChainID(instance.NetVersion)
-			c.InitNonce(instance.GetTransactionCount(c.GetAddress()))
+// For metrics
+var (
+	upstreamRequests = metrics.GetInstance().Counter("eth_proxy_upstream_requests_total", "Requests to Ether node by result", "chain", "upstream", "result")
+	upstreamDuration = metrics.GetInstance().Histogram("eth_proxy_upstream_duration_seconds", "Latency of Ether node", metrics.DefBuckets, "chain", "upstream")
+	upstreamRetries  = metrics.GetInstance().Counter("eth_proxy_upstream_retries_total", "Requests retried to Ether node", "chain")
+	upstreamAvail    = metrics.GetInstance().Gauge("eth_proxy_upstream_available", "Ether nodes not excluded by failures", "chain")
+	// Hedges are reads sent to a second node, whose wins are by winner, first or hedge
+	upstreamHedges    = metrics.GetInstance().Counter("eth_proxy_upstream_hedges_total", "Reads hedged to a second Ether node", "chain")
+	upstreamHedgeWins = metrics.GetInstance().Counter("eth_proxy_upstream_hedge_wins_total", "Hedged reads by request answered first", "chain", "winner")
+	// Divergences are answers of a node different from the majority of quorum
+	upstreamDivergences = metrics.GetInstance().Counter("eth_proxy_upstream_divergences_total", "Answers of Ether node differing from quorum", "chain", "upstream")
+	// Archive retries are reads sent to an archive node after a node lacked state of the block
+	upstreamArchiveRetries = metrics.GetInstance().Counter("eth_proxy_upstream_archive_retries_total", "Reads retried to archive node for missing state", "chain")
+)
+
+func init() {
+	metrics.GetInstance().OnCollect(func() {
+		registryMu.RLock()
+		defer registryMu.RUnlock()
+		upstreamAvail.Reset()
+		for name, r := range registry {
+			upstreamAvail.Set(float64(r.Available()), name)
 		}
 	})
-	return instance
 }
 
-func randomURL(netType string) (url string) {
-	switch netType {
+// ctxKey is a context key for RPC
+type ctxKey struct{}
+
+// GetInstance returns RPC of default chain given by NetType
+func GetInstance() *RPC {
+	return Get(NetType)
+}
+
+// Get returns RPC of the chain, or nil if it is not registered
+// Without Configure, mainnet and testnet are made from MainnetUrls and TestnetUrls
+func Get(chain string) *RPC {
+	chain = chainName(chain)
+	registryMu.RLock()
+	r, done := registry[chain], configured
+	registryMu.RUnlock()
+	if r != nil || done || (chain != config.Mainnet && chain != config.Testnet) {
+		return r
+	}
+
+	registryMu.Lock()
+	if r = registry[chain]; r == nil && !configured {
+		c := config.Chain{Urls: TestnetUrls, WsUrls: TestnetWsUrls}
+		if chain == config.Mainnet {
+			c = config.Chain{Urls: MainnetUrls, WsUrls: MainnetWsUrls}
+		}
+		r = newRPC(chain, c, config.Default().RPC)
+		registry[chain] = r
+	}
+	registryMu.Unlock()
+	return r
+}
+
+// chainName returns name of the chain in config, mapping Mainnet and Testnet to it
+func chainName(chain string) string {
+	switch chain {
 	case Mainnet:
-		url = MainnetUrls[rand.Intn(availLen[Mainnet])]
-		break
+		return config.Mainnet
 	case Testnet:
-		url = TestnetUrls[rand.Intn(availLen[Testnet])]
-		break
+		return config.Testnet
 	}
-	return
+	return chain
 }
 
-func (r *RPC) getURL() string {
-	return randomURL(r.NetType)
+// GetByChainID returns RPC of the chain having chain ID, or nil if there is none
+func GetByChainID(chainID *big.Int) *RPC {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, r := range registry {
+		if r.NetVersion != nil && r.NetVersion.Cmp(chainID) == 0 {
+			return r
+		}
+	}
+	return nil
 }
 
-// GetEthClient returns ether client among urls included in target net
-func (r *RPC) GetEthClient() *ethclient.Client {
-	url := randomURL(r.NetType)
-	if ethClients[url] == nil {
-		ethClients[url], _ = ethclient.Dial(url)
+// Chains returns names of registered chains
+func Chains() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
 	}
-	return ethClients[url]
+	return names
 }
 
-// refreshURLList sorts url list to avoid bad nodes
-// which is not responsible for our request in the past
-func (r *RPC) refreshURLList(url string) {
-	httpFailCnt[url]++
-	if httpFailCnt[url] <= threshold {
-		return
+// Configure registers RPC of every chain with timeout and retry settings
+// A registered chain keeps its state and only its node pool is replaced,
+// so requests in flight finish with the node and client they took
+func Configure(chains map[string]config.Chain, settings config.RPC) {
+	named := make(map[string]config.Chain, len(chains))
+	for name, chain := range chains {
+		named[chainName(name)] = chain
 	}
+	chains = named
 
-	// Pick url list following NetType
-	var p *[]string
-	switch r.NetType {
-	case Mainnet:
-		p = &MainnetUrls
-		break
-	case Testnet:
-		p = &TestnetUrls
-		break
+	added := make(map[string]config.Chain)
+	registryMu.Lock()
+	configured = true
+	for name, chain := range chains {
+		if r := registry[name]; r != nil {
+			r.setPool(chain, settings)
+		} else {
+			added[name] = chain
+		}
 	}
+	for name, r := range registry {
+		if _, ok := chains[name]; !ok {
+			r.close()
+			delete(registry, name)
+		}
+	}
+	registryMu.Unlock()
 
-	// Pick item will be deleted
-	delIdx := -1
-	for i, item := range *p {
-		if item == url {
-			delIdx = i
-			break
+	// Resolve chain state out of lock because it takes round trips
+	for name, chain := range added {
+		r := newRPC(name, chain, settings)
+		registryMu.Lock()
+		registry[name] = r
+		registryMu.Unlock()
+	}
+}
+
+// newRPC returns RPC of the chain whose state is resolved from node
+func newRPC(name string, chain config.Chain, settings config.RPC) *RPC {
+	r := &RPC{NetType: name}
+	r.setPool(chain, settings)
+	r.initChain(chain.ChainID)
+	return r
+}
+
+// setPool replaces node pool, settings and HTTP client
+func (r *RPC) setPool(chain config.Chain, settings config.RPC) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.clients
+	r.settings = settings
+	r.upstreams = chain.AllUpstreams()
+	r.wsUpstreams = wsUpstreams(chain)
+	if r.pool != nil {
+		r.pool.close()
+	}
+	r.pool = newPool(chain, settings, r.pool)
+	go r.pool.run(r.probe)
+	// Ether clients are made again since settings of their upstreams may change
+	r.ethClients = make(map[string]*ethclient.Client)
+	r.initClient()
+	closeClients(old)
+}
+
+// closeClients closes connections of clients once requests in flight are done
+// Every client shares transport of HTTP or has its own connection
+func closeClients(clients map[string]*http.Client) {
+	for _, c := range clients {
+		if t, ok := c.Transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+// initChain resolves chain ID and gas price
+// Crypto is initialized with default chain
+func (r *RPC) initChain(chainID uint64) {
+	r.NetVersion = r.GetChainID()
+	if chainID != 0 && (r.NetVersion == nil || r.NetVersion.Uint64() != chainID) {
+		log.Errorf("rpc: chain %s is expected to be %d but %v", r.NetType, chainID, r.NetVersion)
+		r.NetVersion = new(big.Int).SetUint64(chainID)
+	} else if r.NetVersion == nil {
+		log.Errorf("rpc: failed to resolve chain ID of %s", r.NetType)
+	}
+	r.GasPrice = r.GetGasPrice()
+
+	if c := crypto.GetInstance(); c != nil && r.NetType == chainName(NetType) {
+		c.InitChainID(r.NetVersion)
+		c.InitNonce(r.GetTransactionCount(c.GetAddress()))
+	}
+}
+
+// Signer returns transaction signer of the chain
+func (r *RPC) Signer() types.Signer {
+	if r.NetVersion == nil {
+		return types.HomesteadSigner{}
+	}
+	return types.NewEIP155Signer(r.NetVersion)
+}
+
+// NewContext returns context carrying RPC of a chain
+func NewContext(ctx context.Context, r *RPC) context.Context {
+	return context.WithValue(ctx, ctxKey{}, r)
+}
+
+// FromContext returns RPC carried by context, or RPC of default chain if there is none
+func FromContext(ctx context.Context) *RPC {
+	if ctx != nil {
+		if r, ok := ctx.Value(ctxKey{}).(*RPC); ok {
+			return r
 		}
 	}
+	return GetInstance()
+}
 
-	// Ignore if this url is already removed or not found
-	if delIdx >= availLen[r.NetType] || delIdx < 0 {
-		return
+// close stops probing nodes of the chain no longer served
+func (r *RPC) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pool != nil {
+		r.pool.close()
+		r.pool = nil
 	}
+	closeClients(r.clients)
+}
 
-	// Swap last item and the item will be deleted
-	l := availLen[r.NetType]
-	(*p)[l-1], (*p)[delIdx] = (*p)[delIdx], (*p)[l-1]
+// getPool returns node pool, which is nil after close
+func (r *RPC) getPool() *pool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
 
-	// Decrease available length of url list
-	availLen[r.NetType]--
+// probe returns head block of the node, which also checks if it responds
+func (r *RPC) probe(url string) (uint64, error) {
+	r.mu.RLock()
+	client, timeout := r.clientOf(url), r.settings.Timeout
+	r.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	result, err := callNode(ctx, client, url, "eth_blockNumber")
+	if err != nil {
+		return 0, err
+	}
+	var head hexutil.Uint64
+	if err = json.Unmarshal(result, &head); err != nil {
+		return 0, err
+	}
+	return uint64(head), nil
+}
+
+// GetWsUpstream returns WebSocket upstream of the chain serving subscriptions
+// It has blank URL when the chain has none
+func (r *RPC) GetWsUpstream() config.Upstream {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.wsUpstreams) == 0 {
+		return config.Upstream{}
+	}
+	return r.wsUpstreams[rand.Intn(len(r.wsUpstreams))]
+}
+
+// wsUpstreams returns ws urls of the chain followed by its upstreams of WebSocket
+// with their headers and credentials
+func wsUpstreams(chain config.Chain) []config.Upstream {
+	ups := make([]config.Upstream, 0, len(chain.WsUrls))
+	for _, u := range chain.WsUrls {
+		ups = append(ups, config.Upstream{URL: u})
+	}
+	for _, up := range chain.Upstreams {
+		if u, err := url.Parse(up.URL); err == nil && (u.Scheme == "ws" || u.Scheme == "wss") {
+			ups = append(ups, up)
+		}
+	}
+	return ups
+}
+
+// GetEthClient returns ether client among urls of the chain
+// which sends requests with headers and credentials of the upstream
+// It returns nil when the chain has no node
+func (r *RPC) GetEthClient() *ethclient.Client {
+	p := r.getPool()
+	if p == nil {
+		return nil
+	}
+	n := p.pick(0)
+	if n == nil {
+		return nil
+	}
+	url := n.url
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ethClients[url] == nil {
+		if c, err := gethrpc.DialHTTPWithClient(url, r.clientOf(url)); err == nil {
+			r.ethClients[url] = ethclient.NewClient(c)
+		}
+	}
+	return r.ethClients[url]
+}
+
+// Available returns the number of nodes not excluded by failures
+func (r *RPC) Available() int {
+	r.mu.RLock()
+	p := r.pool
+	r.mu.RUnlock()
+	if p == nil {
+		return 0
+	}
+	return p.available()
 }
 
 // InitClient initializes HTTP client to reduce handshaking overhead
 func (r *RPC) InitClient() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.initClient()
+}
+
+// Every upstream has its own client sharing connections of the transport
+func (r *RPC) initClient() {
+	httpTimeout := time.Duration(r.settings.Timeout)
 	netTransport := &http.Transport{
 		Dial: (&net.Dialer{
 			Timeout: time.Second * httpTimeout,
@@ -158,64 +397,316 @@ func (r *RPC) InitClient() {
 		Timeout:   time.Second * httpTimeout,
 		Transport: netTransport,
 	}
+	r.clients = make(map[string]*http.Client, len(r.upstreams))
+	for _, up := range r.upstreams {
+		r.clients[up.URL] = newUpstreamClient(up, netTransport, r.settings.Timeout)
+	}
+}
+
+// clientOf returns HTTP client of the upstream, which must be called with lock
+func (r *RPC) clientOf(url string) *http.Client {
+	if c, ok := r.clients[url]; ok {
+		return c
+	}
+	return r.client
 }
 
 // DoRPC invokes HTTP post request to ethereum node
-// Retry when fail, give penalty to low-latency node
-func (r *RPC) DoRPC(req interface{}) (ret string, err error) {
-	// Get url following NetType
-	url := r.getURL()
+// Concurrent identical RPCRequests of idempotent method are coalesced into a post
+// and each of them gets the response having its own id
+func (r *RPC) DoRPC(req interface{}) (string, error) {
+	return r.DoRPCContext(context.Background(), req)
+}
+
+// DoRPCContext invokes RPC as DoRPC does until ctx is done
+// Requests to nodes are cancelled with ctx unless they are shared with others
+func (r *RPC) DoRPCContext(ctx context.Context, req interface{}) (string, error) {
+	ret, _, err := r.DoRPCRouteContext(ctx, req)
+	return ret, err
+}
+
+// DoRPCRoute invokes RPC as DoRPC does and returns Route which served it
+func (r *RPC) DoRPCRoute(req interface{}) (string, Route, error) {
+	return r.DoRPCRouteContext(context.Background(), req)
+}
+
+// DoRPCRouteContext invokes RPC as DoRPCContext does and returns Route which served it
+func (r *RPC) DoRPCRouteContext(ctx context.Context, req interface{}) (string, Route, error) {
+	rpcReq, ok := req.(ethjson.RPCRequest)
+	if !ok || !ethjson.IsIdempotent(rpcReq.Method) {
+		return r.post(ctx, req)
+	}
+	ret, route, err, shared := r.inflight.do(ctx, rpcReq.Canonical(), func(ctx context.Context) (string, Route, error) {
+		return r.post(ctx, req)
+	})
+	if shared && err == nil {
+		if b, e := ethjson.ReplaceID([]byte(ret), rpcReq.ID); e == nil {
+			ret = string(b)
+		}
+	}
+	return ret, route, err
+}
 
+// post invokes HTTP post request to ethereum node until ctx is done
+// A request naming block explicitly goes to a node having the block,
+// and a state query of a block older than full nodes keep goes to archive nodes only.
+// A request of idempotent method is hedged to another node when it is slow
+func (r *RPC) post(ctx context.Context, req interface{}) (ret string, route Route, err error) {
 	// Validate request type
 	var msg string
+	var rpcReq ethjson.RPCRequest
 	switch req.(type) {
 	case string:
 		msg, _ = req.(string)
+		rpcReq, _ = ethjson.GetRPCRequestFromJSON(msg)
 		break
 	case ethjson.RPCRequest:
 		if marshal, e := json.Marshal(req); e == nil {
 			msg = string(marshal)
+			rpcReq = req.(ethjson.RPCRequest)
 			break
 		}
 	default:
 		err = fmt.Errorf("Invalid req type")
 		return
 	}
+	block, _ := ethjson.BlockNumber(rpcReq)
 
-	// HTTP request
-	reqBody := bytes.NewBufferString(msg)
-	var resp *http.Response
-	var respBody []byte
-	for i := 0; i < retryCnt; i++ {
-		resp, err = r.client.Post(url, ContentType, reqBody)
-		if err != nil {
-			r.refreshURLList(url)
-			continue
+	// Get node following NetType
+	p := r.getPool()
+	if p == nil {
+		err = fmt.Errorf("no node of %s", r.NetType)
+		return
+	}
+	exclude := historyExclude(p, rpcReq)
+	if rpcReq.Method != "" && ethjson.IsIdempotent(rpcReq.Method) {
+		if delay, ok := r.hedgeDelay(p); ok {
+			return r.hedge(ctx, p, block, rpcReq.Method, msg, delay, exclude...)
 		}
-		respBody, err = ioutil.ReadAll(resp.Body)
-		if err == nil {
+	}
+	n := p.acquire(block, exclude...)
+	if n == nil {
+		err = fmt.Errorf("no node of %s", r.NetType)
+		return
+	}
+	defer p.release(n)
+	return r.send(ctx, p, n, block, rpcReq.Method, msg, exclude...)
+}
+
+// historyExclude returns full nodes when the request queries historical state, which archive nodes serve only
+func historyExclude(p *pool, req ethjson.RPCRequest) []*node {
+	if block, ok := ethjson.StateBlock(req); ok && p.historical(block) {
+		return p.fullNodes()
+	}
+	return nil
+}
+
+// hedgeDelay returns time to wait for the first node before hedging
+// It is false when hedging is disabled or latencies are not sampled enough
+func (r *RPC) hedgeDelay(p *pool) (time.Duration, bool) {
+	r.mu.RLock()
+	q := r.settings.HedgePercentile
+	r.mu.RUnlock()
+	if q <= 0 {
+		return 0, false
+	}
+	return p.percentile(q)
+}
+
+// hedge sends msg to a node, and to another node as well when the first one
+// has not answered in delay. The first success is returned and the other is cancelled.
+// Nodes in exclude are never sent msg.
+func (r *RPC) hedge(ctx context.Context, p *pool, block uint64, method, msg string, delay time.Duration, exclude ...*node) (string, Route, error) {
+	type result struct {
+		ret    string
+		route  Route
+		err    error
+		winner string
+	}
+	first := p.acquire(block, exclude...)
+	if first == nil {
+		return "", Route{}, fmt.Errorf("no node of %s", r.NetType)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Buffered not to block the loser after return
+	results := make(chan result, 2)
+	send := func(n *node, winner string, exclude ...*node) {
+		defer p.release(n)
+		ret, route, err := r.send(ctx, p, n, block, method, msg, exclude...)
+		results <- result{ret, route, err, winner}
+	}
+	go send(first, "first", exclude...)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		return res.ret, res.route, res.err
+	case <-timer.C:
+	}
+	pending := 1
+	if second := p.acquire(block, append(exclude, first)...); second != nil {
+		upstreamHedges.Inc(r.NetType)
+		go send(second, "hedge", append(exclude, first)...)
+		pending++
+	}
+	var res result
+	for i := 0; i < pending; i++ {
+		if res = <-results; res.err == nil {
 			break
 		}
 	}
-	if len(respBody) == 0 {
-		return
+	if pending > 1 && res.err == nil {
+		upstreamHedgeWins.Inc(r.NetType, res.winner)
 	}
+	return res.ret, res.route, res.err
+}
 
-	ret = string(respBody)
-	resp.Body.Close()
+// send invokes HTTP post request to the node until ctx is done
+// A failed request is retried following retry policy of the method with backoff,
+// on a node other than those tried and exclude as long as there is one.
+// A read which the node lacks state for is sent again to an archive node not tried.
+// Failures give penalty to nodes. n is released by caller and other nodes tried here.
+func (r *RPC) send(ctx context.Context, p *pool, n *node, block uint64, method, msg string, exclude ...*node) (ret string, route Route, err error) {
+	r.mu.RLock()
+	retry := r.settings.RetryCount
+	base := time.Duration(r.settings.RetryBackoff) * time.Millisecond
+	r.mu.RUnlock()
+	policy := policyOf(method)
+
+	cur := n
+	defer func() {
+		if cur != n {
+			p.release(cur)
+		}
+	}()
+	tried := append([]*node{n}, exclude...)
+	var a attempt
+	for i := 0; i < retry; i++ {
+		if i > 0 {
+			if !backoff(ctx, base, i) {
+				err = ctx.Err()
+				return
+			}
+			upstreamRetries.Inc(r.NetType)
+			if next := p.acquire(block, tried...); next != nil {
+				if cur != n {
+					p.release(cur)
+				}
+				cur = next
+				tried = append(tried, next)
+			}
+		}
+		route = p.route(cur)
+		start := time.Now()
+		r.mu.RLock()
+		client := r.clientOf(cur.url)
+		r.mu.RUnlock()
+		a = deliver(ctx, client, cur.url, msg)
+		if ctx.Err() != nil {
+			// Cancelled request is not a fault of the node
+			r.observe(route.Node, start, ctx.Err())
+			err = ctx.Err()
+			return
+		}
+		fault := a.fault()
+		r.observe(route.Node, start, fault)
+		p.report(cur, time.Since(start), fault)
+		if fault == nil {
+			p.sample(time.Since(start))
+			break
+		}
+		if !a.retryable(policy) {
+			break
+		}
+	}
+	switch {
+	case a.err != nil:
+		err = a.err
+	case a.throttled() && rpcError(a.body) == nil:
+		err = fmt.Errorf("node responded %d %s", a.status, http.StatusText(a.status))
+	case len(a.body) == 0:
+		err = fmt.Errorf("empty response from node")
+	default:
+		ret = string(a.body)
+	}
+	if err == nil && policy == retryTransient && missingState(a.body) {
+		// Archive node is never a node tried, whose state is missing as well
+		except := append(p.fullNodes(), tried...)
+		if next := p.acquire(block, except...); next != nil {
+			defer p.release(next)
+			upstreamArchiveRetries.Inc(r.NetType)
+			return r.send(ctx, p, next, block, method, msg, except...)
+		}
+	}
+	return
+}
+
+// deliver posts msg to the node once
+func deliver(ctx context.Context, client *http.Client, rawurl, msg string) (a attempt) {
+	httpReq, err := http.NewRequest("POST", rawurl, strings.NewReader(msg))
+	if err != nil {
+		a.err = err
+		return
+	}
+	httpReq.Header.Set("Content-Type", ContentType)
+	resp, err := client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		// Error having URL may expose credentials in it
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		a.err = err
+		return
+	}
+	defer resp.Body.Close()
+	a.status = resp.StatusCode
+	a.body, a.err = ioutil.ReadAll(resp.Body)
 	return
 }
 
+// observe records a result of request to node
+func (r *RPC) observe(upstream string, start time.Time, err error) {
+	upstreamDuration.Observe(time.Since(start).Seconds(), r.NetType, upstream)
+	result := "ok"
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		result = "cancelled"
+	} else if err != nil {
+		result = "error"
+	}
+	upstreamRequests.Inc(r.NetType, upstream, result)
+}
+
+// upstreamLabel returns host of node URL not to expose its path and query
+// which may have credentials, or path of unix socket
+func upstreamLabel(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	switch {
+	case err != nil:
+	case u.Host != "":
+		return u.Host
+	case u.Scheme == "unix":
+		return u.Path
+	}
+	return "unknown"
+}
+
 func initRPCRequest(method string) ethjson.RPCRequest {
 	return ethjson.RPCRequest{
 		Jsonrpc: initParamJsonrpc,
-		ID:      initParamID,
+		ID:      []byte(initParamID),
 		Method:  method,
 	}
 }
 
 // Call invokes RPC "eth_call"
 func (r *RPC) Call(to, data string) (string, error) {
+	return r.CallContext(context.Background(), to, data)
+}
+
+// CallContext invokes RPC "eth_call" with ctx
+func (r *RPC) CallContext(ctx context.Context, to, data string) (string, error) {
 	req := initRPCRequest("eth_call")
 	params := map[string]string{
 		"to":   to,
@@ -223,60 +714,99 @@ func (r *RPC) Call(to, data string) (string, error) {
 	}
 	req.Params = append(req.Params, params)
 	req.Params = append(req.Params, "latest")
-	return r.DoRPC(req)
+	return r.DoRPCContext(ctx, req)
 }
 
 // GetCode invokes RPC "eth_getCode"
 func (r *RPC) GetCode(addr string) (string, error) {
+	return r.GetCodeContext(context.Background(), addr)
+}
+
+// GetCodeContext invokes RPC "eth_getCode" with ctx
+func (r *RPC) GetCodeContext(ctx context.Context, addr string) (string, error) {
 	req := initRPCRequest("eth_getCode")
 	req.Params = append(req.Params, addr)
 	req.Params = append(req.Params, "latest")
-	return r.DoRPC(req)
+	return r.DoRPCContext(ctx, req)
 }
 
 // GetChainID invokes RPC "net_version"
 func (r *RPC) GetChainID() *big.Int {
+	return r.GetChainIDContext(context.Background())
+}
+
+// GetChainIDContext invokes RPC "net_version" with ctx
+func (r *RPC) GetChainIDContext(ctx context.Context) *big.Int {
 	req := initRPCRequest("net_version")
-	if netVersion, err := r.DoRPC(req); err == nil {
+	if netVersion, err := r.DoRPCContext(ctx, req); err == nil {
 		resp := ethjson.GetRPCResponseFromJSON(netVersion)
-		offset, base := common.FindOffsetNBase(resp.Result.(string))
-		if chainID, ok := zero.SetString(resp.Result.(string)[offset:], base); ok {
-			return chainID
+		if result, ok := resp.Result.(string); ok {
+			offset, base := common.FindOffsetNBase(result)
+			if chainID, ok := new(big.Int).SetString(result[offset:], base); ok {
+				return chainID
+			}
 		}
 	}
 	return nil
 }
 
 // GetGasPrice invokes RPC "eth_gasPrice"
+// It returns 0 on error
 func (r *RPC) GetGasPrice() uint64 {
-	req := initRPCRequest("eth_gasPrice")
-	if gasPrice, err := r.DoRPC(req); err == nil {
-		resp := ethjson.GetRPCResponseFromJSON(gasPrice)
-		offset, base := common.FindOffsetNBase(resp.Result.(string))
-		if uint64GasPrice, ok := zero.SetString(resp.Result.(string)[offset:], base); ok {
-			return uint64GasPrice.Uint64()
-		}
+	gasPrice, _ := r.GetGasPriceContext(context.Background())
+	return gasPrice
+}
+
+// GetGasPriceContext invokes RPC "eth_gasPrice" with ctx
+func (r *RPC) GetGasPriceContext(ctx context.Context) (uint64, error) {
+	var gasPrice hexutil.Big
+	if err := r.callResult(ctx, &gasPrice, "eth_gasPrice"); err != nil {
+		return 0, err
+	}
+	return (*big.Int)(&gasPrice).Uint64(), nil
+}
+
+// GetBlockNumber invokes RPC "eth_blockNumber"
+func (r *RPC) GetBlockNumber() (uint64, error) {
+	return r.GetBlockNumberContext(context.Background())
+}
+
+// GetBlockNumberContext invokes RPC "eth_blockNumber" with ctx
+func (r *RPC) GetBlockNumberContext(ctx context.Context) (uint64, error) {
+	req := initRPCRequest("eth_blockNumber")
+	respBody, err := r.DoRPCContext(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	resp := ethjson.GetRPCResponseFromJSON(respBody)
+	if resp.Error != nil {
+		return 0, resp.Error
 	}
-	return 0
+	result, _ := resp.Result.(string)
+	return hexutil.DecodeUint64(result)
 }
 
 // GetTransactionCount invokes RPC "eth_getTransactionCount"
+// It returns 0 on error
 func (r *RPC) GetTransactionCount(addr string) uint64 {
-	req := initRPCRequest("eth_getTransactionCount")
-	req.Params = append(req.Params, addr)
-	req.Params = append(req.Params, "latest")
-	if retStr, txCntErr := r.DoRPC(req); txCntErr == nil {
-		resp := ethjson.GetRPCResponseFromJSON(retStr)
-		offset, base := common.FindOffsetNBase(resp.Result.(string))
-		if txNonce, ok := zero.SetString(resp.Result.(string)[offset:], base); ok {
-			return txNonce.Uint64()
-		}
-	}
-	return 0
+	nonce, _ := r.GetTransactionCountContext(context.Background(), addr)
+	return nonce
+}
+
+// GetTransactionCountContext invokes RPC "eth_getTransactionCount" with ctx
+func (r *RPC) GetTransactionCountContext(ctx context.Context, addr string) (uint64, error) {
+	var nonce hexutil.Uint64
+	err := r.callResult(ctx, &nonce, "eth_getTransactionCount", addr, "latest")
+	return uint64(nonce), err
 }
 
 // SendTransaction invokes RPC "eth_sendTransaction"
 func (r *RPC) SendTransaction(from, to, data string, gas int) (string, error) {
+	return r.SendTransactionContext(context.Background(), from, to, data, gas)
+}
+
+// SendTransactionContext invokes RPC "eth_sendTransaction" with ctx
+func (r *RPC) SendTransactionContext(ctx context.Context, from, to, data string, gas int) (string, error) {
 	req := initRPCRequest("eth_sendTransaction")
 	params := map[string]string{
 		"from": from,
@@ -285,12 +815,17 @@ func (r *RPC) SendTransaction(from, to, data string, gas int) (string, error) {
 		"data": data,
 	}
 	req.Params = append(req.Params, params)
-	return r.DoRPC(req)
+	return r.DoRPCContext(ctx, req)
 }
 
 // SendRawTransaction invokes RPC "eth_sendRawTransaction"
 func (r *RPC) SendRawTransaction(raw []byte) (string, error) {
+	return r.SendRawTransactionContext(context.Background(), raw)
+}
+
+// SendRawTransactionContext invokes RPC "eth_sendRawTransaction" with ctx
+func (r *RPC) SendRawTransactionContext(ctx context.Context, raw []byte) (string, error) {
 	req := initRPCRequest("eth_sendRawTransaction")
 	req.Params = append(req.Params, hexutil.Encode(raw))
-	return r.DoRPC(req)
+	return r.DoRPCContext(ctx, req)
 }
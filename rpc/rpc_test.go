@@ -1,13 +1,33 @@
 package rpc
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
 	"github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/metrics"
 
+	ethereum "github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"golang.org/x/net/websocket"
 )
 
 func TestEthClient(t *testing.T) {
@@ -58,7 +78,7 @@ func BenchmarkHttpClient(b *testing.B) {
 	r := GetInstance()
 	req := json.RPCRequest{
 		Jsonrpc: "2.0",
-		ID:      1,
+		ID:      []byte("1"),
 		Method:  "eth_getBalance",
 	}
 	req.Params = append(req.Params, "0x00F912f1F41203DaE29b37fc18db8Dbd3cA9833F")
@@ -74,16 +94,213 @@ func BenchmarkHttpClient(b *testing.B) {
 	b.Logf("errCnt %d", errCnt)
 }
 
-func TestRefreshUrlList(t *testing.T) {
-	NetType = Testnet
-	r := GetInstance()
-	initLen := len(TestnetUrls)
-	target := TestnetUrls[0]
-	for i := 0; i < 30; i++ {
-		r.refreshURLList(target)
+// testPool returns pool whose threshold is 3 and cooldown is 10 seconds with stopped clock
+func testPool(chain config.Chain, prev *pool) *pool {
+	settings := config.Default().RPC
+	settings.FailThreshold, settings.Cooldown = 3, 10
+	p := newPool(chain, settings, prev)
+	now := time.Unix(1500000000, 0)
+	p.now = func() time.Time { return now }
+	for _, n := range p.nodes {
+		n.updated = now
+	}
+	return p
+}
+
+func TestPool(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	p := testPool(config.Chain{Urls: []string{"a", "b"}}, nil)
+	p.now = func() time.Time { return now }
+	a, b := p.nodes[0], p.nodes[1]
+
+	// Failures decay by half every cooldown
+	p.failure(a)
+	p.failure(a)
+	now = now.Add(10 * time.Second)
+	p.failure(a)
+	if a.state != closed || a.failures != 2 {
+		t.Fatalf("Decayed failures should not open breaker: %s %v", a.state, a.failures)
+	}
+	p.failure(a)
+	if a.state != open || p.available() != 1 {
+		t.Fatalf("Breaker should be open at threshold: %s", a.state)
+	}
+	for i := 0; i < 10; i++ {
+		if p.pick(0) != b {
+			t.Fatalf("Open node should be excluded")
+		}
+	}
+
+	// Open node is probed after cooldown
+	if len(p.due()) != 0 {
+		t.Errorf("Node should not be probed before cooldown")
+	}
+	now = now.Add(10 * time.Second)
+	if due := p.due(); len(due) != 1 || due[0] != a || a.state != halfOpen {
+		t.Fatalf("Node should be half-open after cooldown: %s", a.state)
+	}
+	p.failure(a)
+	if a.state != open {
+		t.Fatalf("Failed probe should open breaker again: %s", a.state)
+	}
+	now = now.Add(10 * time.Second)
+	p.due()
+	p.report(a, time.Second, nil)
+	if a.state != closed || a.failures != 0 || p.available() != 2 {
+		t.Fatalf("Successful probe should close breaker: %s %v", a.state, a.failures)
+	}
+
+	// Node having the least failures serves when every node is open
+	for i := 0; i < 3; i++ {
+		p.failure(a)
+	}
+	for i := 0; i < 5; i++ {
+		p.failure(b)
+	}
+	if p.available() != 0 || p.pick(0) != a {
+		t.Errorf("Node having the least failures should be picked")
+	}
+
+	// State is kept for the same url
+	p = testPool(config.Chain{Urls: []string{"b", "c"}}, p)
+	if p.available() != 1 || p.nodes[0].state != open || p.nodes[1].state != closed {
+		t.Errorf("State should be kept for the same url")
+	}
+	if testPool(config.Chain{}, nil).pick(0) != nil {
+		t.Errorf("Pool without node should give nil")
+	}
+
+	// State is copied while requests in flight on the previous pool update it
+	prev := testPool(config.Chain{Urls: []string{"a", "b"}}, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			n := prev.acquire(0)
+			prev.report(n, time.Millisecond, nil)
+			prev.setHead(n, uint64(i))
+			prev.release(n)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if p = testPool(config.Chain{Urls: []string{"a", "b"}}, prev); p.nodes[0] == prev.nodes[0] || p.nodes[0].inflight != 0 {
+			t.Fatalf("Nodes should be copied without requests in flight")
+		}
+	}
+	<-done
+}
+
+func TestHead(t *testing.T) {
+	p := testPool(config.Chain{Urls: []string{"a", "b", "c"}, Strategy: config.RoundRobin}, nil)
+	p.maxLag = 2
+	a, b, c := p.nodes[0], p.nodes[1], p.nodes[2]
+	p.setHead(a, 100)
+	p.setHead(b, 97)
+	p.setHead(c, 99)
+	for i := 0; i < 4; i++ {
+		if p.pick(0) == b {
+			t.Fatalf("Lagging node should be excluded")
+		}
+	}
+	if got := p.pick(97).url + p.pick(97).url + p.pick(97).url; got != "cab" {
+		t.Errorf("Lagging node should serve a block it has: %s", got)
+	}
+	for i := 0; i < 4; i++ {
+		if p.pick(100) != a {
+			t.Fatalf("Only node having the block should be picked")
+		}
+	}
+	if p.pick(101) != a {
+		t.Errorf("Node having the highest head should be picked for a future block")
 	}
-	if (initLen - 1) != availLen[Testnet] {
-		t.Errorf("refreshUrlList is abnormal")
+	if route := p.route(a); route.Node != "unknown" || route.Head != 100 {
+		t.Errorf("Unexpected route: %+v", route)
+	}
+
+	// Head not polled yet does not exclude the node
+	p = testPool(config.Chain{Urls: []string{"a", "d"}, Strategy: config.RoundRobin}, p)
+	if got := p.pick(100).url + p.pick(100).url; got != "da" {
+		t.Errorf("Node without head should be picked: %s", got)
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	// picks returns urls of n nodes picked
+	picks := func(p *pool, n int) (urls string) {
+		for i := 0; i < n; i++ {
+			urls += p.pick(0).url
+		}
+		return
+	}
+	urls := []string{"a", "b", "c"}
+
+	p := testPool(config.Chain{Urls: urls, Strategy: config.RoundRobin}, nil)
+	if got := picks(p, 6); got != "bcabca" {
+		t.Errorf("Unexpected round-robin: %s", got)
+	}
+	p.failure(p.nodes[1])
+	p.failure(p.nodes[1])
+	p.failure(p.nodes[1])
+	if got := picks(p, 4); got != "caca" {
+		t.Errorf("Round-robin should skip open node: %s", got)
+	}
+
+	p = testPool(config.Chain{Urls: urls, Strategy: config.Weighted, Weights: []int{5, 1, 1}}, nil)
+	if got := picks(p, 7); got != "aabacaa" {
+		t.Errorf("Unexpected weighted: %s", got)
+	}
+
+	// Node not sampled yet is picked first
+	p = testPool(config.Chain{Urls: urls, Strategy: config.LeastLatency}, nil)
+	p.report(p.nodes[0], 300*time.Millisecond, nil)
+	p.report(p.nodes[2], 100*time.Millisecond, nil)
+	if got := picks(p, 2); got != "bb" {
+		t.Errorf("Node not sampled should be picked: %s", got)
+	}
+	p.report(p.nodes[1], 200*time.Millisecond, nil)
+	if got := picks(p, 2); got != "cc" {
+		t.Errorf("Fastest node should be picked: %s", got)
+	}
+	// Latency is a moving average
+	p.report(p.nodes[2], 800*time.Millisecond, nil)
+	if got := p.nodes[2].latency; got < 0.239 || got > 0.241 {
+		t.Errorf("Unexpected latency: %v", got)
+	}
+	if got := picks(p, 1); got != "b" {
+		t.Errorf("Slowed node should not be picked: %s", got)
+	}
+
+	p = testPool(config.Chain{Urls: urls, Strategy: config.LeastInFlight}, nil)
+	var acquired []*node
+	for i := 0; i < 4; i++ {
+		acquired = append(acquired, p.acquire(0))
+	}
+	if acquired[0] == acquired[1] || acquired[1] == acquired[2] || acquired[0] == acquired[2] {
+		t.Fatalf("Requests should be spread")
+	}
+	p.release(acquired[1])
+	p.release(acquired[1])
+	if got := p.pick(0); got != acquired[1] {
+		t.Errorf("Node having the least requests should be picked: %s", got.url)
+	}
+}
+
+func TestChainName(t *testing.T) {
+	if chainName(Mainnet) != config.Mainnet || chainName(Testnet) != config.Testnet || chainName("side") != "side" {
+		t.Errorf("Mainnet and Testnet should be mapped to chains of config")
+	}
+}
+
+func TestWsUpstreams(t *testing.T) {
+	ups := wsUpstreams(config.Chain{
+		WsUrls: []string{"wss://a.example/ws"},
+		Upstreams: []config.Upstream{
+			{URL: "https://b.example"},
+			{URL: "wss://c.example/ws", Auth: config.AuthBearer, Token: "secret"},
+		},
+	})
+	if len(ups) != 2 || ups[0].URL != "wss://a.example/ws" || ups[1].Token != "secret" {
+		t.Errorf("WebSocket upstreams should keep their credentials: %v", ups)
 	}
 }
 
@@ -106,12 +323,65 @@ func TestRpc(t *testing.T) {
 	}
 
 	// Test with RpcRequest param
-	testRPCRequest := json.GetRPCRequestFromJSON(testMsg)
+	testRPCRequest, _ := json.GetRPCRequestFromJSON(testMsg)
 	if _, err := r.DoRPC(testRPCRequest); err != nil {
 		t.Errorf("Failed to RPC with RpcRequest: %s", err)
 	}
 }
 
+func TestCoalesce(t *testing.T) {
+	var posts int32
+	release := make(chan struct{})
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		req, _ := json.GetRPCRequestFromJSON(string(b))
+		<-release
+		w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":"0x1"}`))
+	}))
+	defer node.Close()
+	r := &RPC{NetType: "test"}
+	r.setPool(config.Chain{Urls: []string{node.URL}}, config.Default().RPC)
+
+	ids := []string{"1", "2", `"a"`}
+	resps := make([]string, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			req, _ := json.GetRPCRequestFromJSON(`{"jsonrpc":"2.0","method":"eth_call","params":[{"to":"0x1"},"latest"],"id":` + id + `}`)
+			resps[i], _ = r.DoRPC(req)
+		}(i, id)
+	}
+	// Wait for every request to join the first one
+	for i := 0; i < 100 && atomic.LoadInt32(&posts) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if atomic.LoadInt32(&posts) != 1 {
+		t.Errorf("Identical requests should be coalesced: %d posts", posts)
+	}
+	for i, id := range ids {
+		if resp := json.GetRPCResponseFromJSON(resps[i]); string(resp.ID) != id || resp.Result != "0x1" {
+			t.Errorf("Waiter should get response having own id %s: %s", id, resps[i])
+		}
+	}
+
+	// Writes are never coalesced
+	atomic.StoreInt32(&posts, 0)
+	req, _ := json.GetRPCRequestFromJSON(`{"jsonrpc":"2.0","method":"eth_sendRawTransaction","params":["0x00"],"id":1}`)
+	for i := 0; i < 2; i++ {
+		r.DoRPC(req)
+	}
+	if atomic.LoadInt32(&posts) != 2 {
+		t.Errorf("Write should not be coalesced: %d posts", posts)
+	}
+}
+
 func BenchmarkRpc(b *testing.B) {
 	testMsg := "{\"jsonrpc\":\"2.0\",\"method\":\"web3_clientVersion\",\"params\":[\"a\",1],\"id\":100}"
 
@@ -121,3 +391,656 @@ func BenchmarkRpc(b *testing.B) {
 		r.DoRPC(testMsg)
 	}
 }
+
+func TestHedge(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Closed connection is detected after body is read
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"slow"}`))
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"fast"}`))
+	}))
+	defer fast.Close()
+
+	settings := config.Default().RPC
+	settings.HedgePercentile = 90
+	r := &RPC{NetType: "hedge"}
+	// Round-robin picks the slow node first
+	r.setPool(config.Chain{Urls: []string{fast.URL, slow.URL}, Strategy: config.RoundRobin}, settings)
+	defer r.close()
+	req, _ := json.GetRPCRequestFromJSON(`{"jsonrpc":"2.0","method":"eth_getCode","params":["0x1","latest"],"id":1}`)
+
+	// Not hedged until latencies are sampled enough
+	if _, ok := r.hedgeDelay(r.getPool()); ok {
+		t.Fatalf("Hedging should wait for samples")
+	}
+	for i := 0; i < minSamples; i++ {
+		r.getPool().sample(10 * time.Millisecond)
+	}
+
+	resp, route, err := r.DoRPCRoute(req)
+	if err != nil || json.GetRPCResponseFromJSON(resp).Result != "fast" || route.Node != upstreamLabel(fast.URL) {
+		t.Fatalf("Hedged request should be answered by the fast node: %s %+v %v", resp, route, err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Loser should be cancelled")
+	}
+
+	var buf bytes.Buffer
+	metrics.GetInstance().WriteText(&buf)
+	for _, expected := range []string{
+		`eth_proxy_upstream_hedges_total{chain="hedge"} 1`,
+		`eth_proxy_upstream_hedge_wins_total{chain="hedge",winner="hedge"} 1`,
+		`eth_proxy_upstream_requests_total{chain="hedge",upstream="` + upstreamLabel(slow.URL) + `",result="cancelled"} 1`,
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Metrics should contain %s", expected)
+		}
+	}
+	if n := r.getPool().nodes[1]; n.failures != 0 {
+		t.Errorf("Cancelled request should not be a failure of the node")
+	}
+
+	// Writes are never hedged, and round-robin turns to the fast node after a pick
+	r.getPool().pick(0)
+	req.Method = "eth_sendRawTransaction"
+	if resp, _ := r.DoRPC(req); json.GetRPCResponseFromJSON(resp).Result != "fast" {
+		t.Errorf("Write should go to the fast node: %s", resp)
+	}
+	buf.Reset()
+	metrics.GetInstance().WriteText(&buf)
+	if !strings.Contains(buf.String(), `eth_proxy_upstream_hedges_total{chain="hedge"} 1`) {
+		t.Errorf("Write should not be hedged")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var badPosts, goodPosts int32
+	badBody := `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badPosts, 1)
+		switch r.URL.Path {
+		case "/429":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/500":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(badBody))
+		}
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodPosts, 1)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"good"}`))
+	}))
+	defer good.Close()
+	down := httptest.NewServer(nil)
+	down.Close()
+
+	settings := config.Default().RPC
+	settings.RetryBackoff = 1
+	tests := []struct {
+		method, bad string
+		posts       int32
+		result      interface{}
+	}{
+		// Idempotent request is retried on another node for throttling and transient error
+		{"eth_call", "/429", 1, "good"},
+		{"eth_call", "/transient", 1, "good"},
+		// Signed transaction is broadcast again when rejected
+		{"eth_sendRawTransaction", "/429", 1, "good"},
+		{"eth_sendRawTransaction", "/transient", 1, nil},
+		// Transaction signed by node is never sent twice
+		{"eth_sendTransaction", "/500", 1, nil},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&badPosts, 0)
+		atomic.StoreInt32(&goodPosts, 0)
+		r := &RPC{NetType: "retry"}
+		// Round-robin picks the bad node first
+		r.setPool(config.Chain{Urls: []string{good.URL, bad.URL + test.bad}, Strategy: config.RoundRobin}, settings)
+		req := initRPCRequest(test.method)
+		resp, _ := r.DoRPC(req)
+		r.close()
+		if atomic.LoadInt32(&badPosts) != test.posts || json.GetRPCResponseFromJSON(resp).Result != test.result {
+			t.Errorf("Unexpected retry of %s on %s: %d posts, %s", test.method, test.bad, badPosts, resp)
+		}
+	}
+
+	// Request not delivered is retried regardless of method
+	r := &RPC{NetType: "retry"}
+	r.setPool(config.Chain{Urls: []string{good.URL, down.URL}, Strategy: config.RoundRobin}, settings)
+	defer r.close()
+	if resp, err := r.DoRPC(initRPCRequest("eth_sendTransaction")); err != nil || json.GetRPCResponseFromJSON(resp).Result != "good" {
+		t.Errorf("Undelivered request should be retried: %s %v", resp, err)
+	}
+
+	// Retries stop at retry count on the only node
+	r.setPool(config.Chain{Urls: []string{bad.URL + "/500"}}, settings)
+	atomic.StoreInt32(&badPosts, 0)
+	if _, err := r.DoRPC(initRPCRequest("eth_call")); err == nil || atomic.LoadInt32(&badPosts) != int32(settings.RetryCount) {
+		t.Errorf("Request should be tried %d times: %d, %v", settings.RetryCount, badPosts, err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	var fullPosts, archivePosts int32
+	full := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fullPosts, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(b), "latest") {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"full"}`))
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing trie node 5c3d (path )"}}`))
+	}))
+	defer full.Close()
+	archive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&archivePosts, 1)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"archive"}`))
+	}))
+	defer archive.Close()
+
+	settings := config.Default().RPC
+	settings.HeadInterval = 0
+	r := &RPC{NetType: "archive"}
+	// Round-robin picks the full node first
+	ups := []config.Upstream{{URL: archive.URL, Archive: true}, {URL: full.URL}}
+	r.setPool(config.Chain{Upstreams: ups, Strategy: config.RoundRobin}, settings)
+	defer r.close()
+	balance := func(block string) string {
+		req := initRPCRequest("eth_getBalance")
+		req.Params = []interface{}{"0x1", block}
+		resp, _ := r.DoRPC(req)
+		result, _ := json.GetRPCResponseFromJSON(resp).Result.(string)
+		return result
+	}
+
+	// Missing state of full node is retried on archive node
+	if got := balance("0x10"); got != "archive" || atomic.LoadInt32(&fullPosts) != 1 || atomic.LoadInt32(&archivePosts) != 1 {
+		t.Errorf("Missing state should be retried on archive node: %s, %d full, %d archive posts", got, fullPosts, archivePosts)
+	}
+
+	// Historical state goes to archive node only once heads are known
+	p := r.getPool()
+	p.setHead(p.nodes[0], 1000)
+	p.setHead(p.nodes[1], 1000)
+	atomic.StoreInt32(&fullPosts, 0)
+	for i := 0; i < 4; i++ {
+		if got := balance("0x10"); got != "archive" {
+			t.Errorf("Historical state should be served by archive node: %s", got)
+		}
+	}
+	if atomic.LoadInt32(&fullPosts) != 0 {
+		t.Errorf("Historical state should not go to full node: %d posts", fullPosts)
+	}
+	for i := 0; i < 2; i++ {
+		balance("latest")
+	}
+	if atomic.LoadInt32(&fullPosts) == 0 {
+		t.Errorf("Recent state should go to full node as well")
+	}
+	if p.historical(1000-uint64(settings.ArchiveDepth)) || !p.historical(999-uint64(settings.ArchiveDepth)) {
+		t.Errorf("State older than archive depth should be historical")
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer node.Close()
+
+	secret := "0x" + strings.Repeat("ab", 32)
+	tests := []struct {
+		upstream      config.Upstream
+		authorization string
+	}{
+		{config.Upstream{Auth: config.AuthBasic, Username: "user", Password: "pass"}, "Basic dXNlcjpwYXNz"},
+		{config.Upstream{Auth: config.AuthBearer, Token: "token"}, "Bearer token"},
+		{config.Upstream{Auth: config.AuthProjectSecret, Token: "secret"}, "Basic OnNlY3JldA=="},
+		{config.Upstream{Auth: config.AuthJWT, Token: secret}, "Bearer "},
+	}
+	for _, test := range tests {
+		test.upstream.URL = node.URL
+		test.upstream.Headers = map[string]string{"X-Client": "proxy"}
+		r := &RPC{NetType: "upstream"}
+		r.setPool(config.Chain{Upstreams: []config.Upstream{test.upstream}}, config.Default().RPC)
+
+		r.DoRPC(initRPCRequest("eth_blockNumber"))
+		h := <-headers
+		if !strings.HasPrefix(h.Get("Authorization"), test.authorization) || h.Get("X-Client") != "proxy" || h.Get("Content-Type") != ContentType {
+			t.Errorf("Request should have settings of %s upstream: %v", test.upstream.Auth, h)
+		}
+		if test.upstream.Auth == config.AuthJWT {
+			token := strings.TrimPrefix(h.Get("Authorization"), "Bearer ")
+			var claims struct{ Iat int64 }
+			if parts := strings.Split(token, "."); len(parts) == 3 {
+				b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+				stdjson.Unmarshal(b, &claims)
+			}
+			expected, _ := signJWT(secret, time.Unix(claims.Iat, 0))
+			if token != expected || time.Since(time.Unix(claims.Iat, 0)) > time.Minute {
+				t.Errorf("JWT should be signed with secret issued now: %s", token)
+			}
+		}
+
+		// Ether client applies them as well
+		r.GetEthClient().NetworkID(context.Background())
+		if h = <-headers; !strings.HasPrefix(h.Get("Authorization"), test.authorization) || h.Get("X-Client") != "proxy" {
+			t.Errorf("Ether client should have settings of %s upstream: %v", test.upstream.Auth, h)
+		}
+		r.close()
+	}
+}
+
+func TestTransport(t *testing.T) {
+	// IPC node answers two requests in reverse order on a connection
+	dir, _ := ioutil.TempDir("", "ipc")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "geth.ipc")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	var conns int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				dec := stdjson.NewDecoder(conn)
+				for {
+					var reqs [2]json.RPCRequest
+					for i := range reqs {
+						if dec.Decode(&reqs[i]) != nil {
+							return
+						}
+					}
+					for i := len(reqs) - 1; i >= 0; i-- {
+						conn.Write([]byte(`{"jsonrpc":"2.0","id":` + string(reqs[i].ID) + `,"result":"` + reqs[i].Method + `"}`))
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	r := &RPC{NetType: "ipc"}
+	r.setPool(config.Chain{Urls: []string{"unix://" + path}}, config.Default().RPC)
+	defer r.close()
+	methods := []string{"eth_chainId", "eth_gasPrice", "net_version", "eth_blockNumber"}
+	resps := make([]string, len(methods))
+	var wg sync.WaitGroup
+	for i, method := range methods {
+		wg.Add(1)
+		go func(i int, method string) {
+			defer wg.Done()
+			req := initRPCRequest(method)
+			req.ID = []byte(`"` + method + `"`)
+			resps[i], _ = r.DoRPC(req)
+		}(i, method)
+	}
+	wg.Wait()
+	for i, method := range methods {
+		if resp := json.GetRPCResponseFromJSON(resps[i]); resp.Result != method || string(resp.ID) != `"`+method+`"` {
+			t.Errorf("Response should be given to its request with its id: %s", resps[i])
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Requests should share a connection: %d", n)
+	}
+	if route := r.getPool().route(r.getPool().nodes[0]); route.Node != path {
+		t.Errorf("IPC node should be named by its path: %s", route.Node)
+	}
+
+	// WebSocket node gets credentials in handshake and Ether client goes through it
+	// It answers with its own key order and spacing, and eth_raw with an object
+	auths := make(chan string, 1)
+	var received atomic.Value
+	node := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		auths <- conn.Request().Header.Get("Authorization")
+		for {
+			var msg string
+			if websocket.Message.Receive(conn, &msg) != nil {
+				return
+			}
+			received.Store(msg)
+			var reqs []json.RPCRequest
+			batch := strings.HasPrefix(msg, "[")
+			if batch {
+				stdjson.Unmarshal([]byte(msg), &reqs)
+			} else {
+				reqs = make([]json.RPCRequest, 1)
+				stdjson.Unmarshal([]byte(msg), &reqs[0])
+			}
+			var resps []string
+			for _, req := range reqs {
+				result := `"137"`
+				if req.Method == "eth_raw" {
+					result = `{"b":1, "a":[ 2 ]}`
+				}
+				if req.ID != nil {
+					resps = append(resps, `{"result" : `+result+`, "id":`+string(req.ID)+`,  "jsonrpc":"2.0"}`)
+				}
+			}
+			out := resps[0]
+			if batch {
+				out = "[ " + strings.Join(resps, ", ") + " ]"
+			}
+			websocket.Message.Send(conn, out)
+		}
+	}))
+	defer node.Close()
+	up := config.Upstream{URL: "ws" + strings.TrimPrefix(node.URL, "http"), Auth: config.AuthBearer, Token: "token"}
+	r.setPool(config.Chain{Upstreams: []config.Upstream{up}}, config.Default().RPC)
+	if id, err := r.GetEthClient().NetworkID(context.Background()); err != nil || id.Int64() != 137 {
+		t.Errorf("Ether client should go through WebSocket: %v %v", id, err)
+	}
+	if resp, err := r.DoRPC(initRPCRequest("net_version")); err != nil || json.GetRPCResponseFromJSON(resp).Result != "137" {
+		t.Errorf("Request should go through WebSocket: %s %v", resp, err)
+	}
+	if auth := <-auths; auth != "Bearer token" {
+		t.Errorf("Handshake should have credentials: %s", auth)
+	}
+
+	// Every byte but id is relayed as it is both ways
+	msg := `{"id":"x", "method":"eth_raw",  "params":[],"jsonrpc":"2.0"}`
+	resp, err := r.DoRPC(msg)
+	if err != nil || resp != `{"result" : {"b":1, "a":[ 2 ]}, "id":"x",  "jsonrpc":"2.0"}` {
+		t.Errorf("Response should be relayed byte for byte: %s %v", resp, err)
+	}
+	sent := received.Load().(string)
+	if start, end, err := json.FindID([]byte(sent)); err != nil || sent[:start]+`"x"`+sent[end:] != msg {
+		t.Errorf("Request should be relayed byte for byte but id: %s", sent)
+	}
+	batch := `[ {"jsonrpc":"2.0","method":"eth_raw","id":1}, {"jsonrpc":"2.0","method":"eth_subscription"}, {"jsonrpc":"2.0","method":"net_version","id":"b"} ]`
+	resp, err = r.DoRPC(batch)
+	if err != nil || resp != `[ {"result" : {"b":1, "a":[ 2 ]}, "id":1,  "jsonrpc":"2.0"}, {"result" : "137", "id":"b",  "jsonrpc":"2.0"} ]` {
+		t.Errorf("Batch should be relayed byte for byte: %s %v", resp, err)
+	}
+}
+
+// brokenStream is a stream failing to write after its transport drops it
+type brokenStream struct {
+	t      *streamTransport
+	closed chan struct{}
+}
+
+func (s *brokenStream) read() ([]byte, error) {
+	<-s.closed
+	return nil, io.EOF
+}
+
+func (s *brokenStream) write([]byte) error {
+	s.t.mu.Lock()
+	s.t.conn = nil
+	s.t.mu.Unlock()
+	return io.ErrClosedPipe
+}
+
+func (s *brokenStream) Close() error {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	return nil
+}
+
+func TestTransportWriteError(t *testing.T) {
+	var tr *streamTransport
+	tr = newStreamTransport(func() (stream, error) {
+		return &brokenStream{t: tr, closed: make(chan struct{})}, nil
+	})
+	if _, err := tr.call(context.Background(), []byte(`{"jsonrpc":"2.0","method":"eth_chainId","id":1}`)); err != io.ErrClosedPipe {
+		t.Errorf("Write error should be returned: %v", err)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.pending) != 0 {
+		t.Errorf("Call failed to write should not be pending: %d", len(tr.pending))
+	}
+}
+
+func TestClient(t *testing.T) {
+	head := &types.Header{Number: big.NewInt(16), Difficulty: big.NewInt(1), Time: big.NewInt(1), TxHash: types.EmptyRootHash, UncleHash: types.EmptyUncleHash}
+	block, _ := stdjson.Marshal(head)
+	block = append(block[:len(block)-1], []byte(`,"hash":"`+head.Hash().Hex()+`","transactions":[],"uncles":[]}`)...)
+	tx, _ := stdjson.Marshal(types.NewTransaction(1, common.HexToAddress("0x1"), big.NewInt(2), 21000, big.NewInt(3), nil))
+	tx = append(tx[:len(tx)-1], []byte(`,"blockNumber":"0x10"}`)...)
+	results := map[string]string{
+		"eth_blockNumber":           `"0x10"`,
+		"eth_getBlockByNumber":      string(block),
+		"eth_getTransactionByHash":  string(tx),
+		"eth_getTransactionReceipt": `null`,
+		"eth_estimateGas":           `"0x5208"`,
+		"eth_getLogs":               `[{"address":"0x0000000000000000000000000000000000000001","topics":[],"data":"0x","blockNumber":"0x10","transactionHash":"` + common.Hash{}.Hex() + `","transactionIndex":"0x0","blockHash":"` + common.Hash{}.Hex() + `","logIndex":"0x0","removed":false}]`,
+		"eth_getBalance":            `"0xde0b6b3a7640000"`,
+		"eth_getStorageAt":          `"0x01"`,
+		"eth_feeHistory":            `{"oldestBlock":"0xf","reward":[["0x1","0x2"]],"baseFeePerGas":["0x7","0x8"],"gasUsedRatio":[0.5]}`,
+	}
+	params := make(chan []interface{}, 1)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		req, _ := json.GetRPCRequestFromJSON(string(b))
+		select {
+		case params <- req.Params:
+		default:
+		}
+		result, ok := results[req.Method]
+		if !ok {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"not found"}}`))
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":` + result + `}`))
+	}))
+	defer node.Close()
+	r := &RPC{NetType: "client"}
+	r.setPool(config.Chain{Urls: []string{node.URL}}, config.Default().RPC)
+	defer r.close()
+	ctx := context.Background()
+	sent := func() []interface{} {
+		select {
+		case p := <-params:
+			return p
+		default:
+			return nil
+		}
+	}
+
+	if n, err := r.BlockNumber(ctx); n != 16 || err != nil {
+		t.Errorf("Failed to get block number: %d %v", n, err)
+	}
+	sent()
+	if b, err := r.GetBlockByNumber(ctx, big.NewInt(16)); err != nil || b.NumberU64() != 16 || b.Hash() != head.Hash() {
+		t.Errorf("Failed to get block: %v", err)
+	}
+	if p := sent(); len(p) != 2 || p[0] != "0x10" || p[1] != true {
+		t.Errorf("Block should be asked by number with transactions: %v", p)
+	}
+	if tx, pending, err := r.GetTransactionByHash(ctx, common.Hash{}); err != nil || pending || tx.Nonce() != 1 || tx.Value().Int64() != 2 {
+		t.Errorf("Failed to get transaction: %v %v", pending, err)
+	}
+	if _, err := r.GetTransactionReceipt(ctx, common.Hash{}); err != ethereum.NotFound {
+		t.Errorf("Null receipt should not be found: %v", err)
+	}
+	if gas, err := r.EstimateGas(ctx, ethereum.CallMsg{}); gas != 21000 || err != nil {
+		t.Errorf("Failed to estimate gas: %d %v", gas, err)
+	}
+	sent()
+	if logs, err := r.GetLogs(ctx, ethereum.FilterQuery{FromBlock: big.NewInt(1), ToBlock: big.NewInt(16)}); err != nil || len(logs) != 1 || logs[0].BlockNumber != 16 {
+		t.Errorf("Failed to get logs: %v %v", logs, err)
+	}
+	if p := sent(); len(p) != 1 || p[0].(map[string]interface{})["toBlock"] != "0x10" {
+		t.Errorf("Filter should have block numbers: %v", p)
+	}
+	if wei, err := r.GetBalance(ctx, common.Address{}, nil); err != nil || wei.String() != "1000000000000000000" {
+		t.Errorf("Failed to get balance: %v %v", wei, err)
+	}
+	if p := sent(); len(p) != 2 || p[1] != "latest" {
+		t.Errorf("Balance should be asked at the latest block: %v", p)
+	}
+	if value, err := r.GetStorageAt(ctx, common.Address{}, common.Hash{}, big.NewInt(1)); err != nil || len(value) != 1 || value[0] != 1 {
+		t.Errorf("Failed to get storage: %v %v", value, err)
+	}
+	h, err := r.FeeHistory(ctx, 2, nil, []float64{25, 75})
+	if err != nil || h.OldestBlock.Int64() != 15 || h.Reward[0][1].Int64() != 2 || h.BaseFee[1].Int64() != 8 || h.GasUsedRatio[0] != 0.5 {
+		t.Errorf("Failed to get fee history: %+v %v", h, err)
+	}
+
+	// Error of node is returned as it is
+	delete(results, "eth_blockNumber")
+	if _, err := r.BlockNumber(ctx); err == nil || err.(*json.RPCError).Code != -32601 {
+		t.Errorf("Error of node should be returned: %v", err)
+	}
+	if gasPrice, err := r.GetGasPriceContext(ctx); gasPrice != 0 || err == nil || err.(*json.RPCError).Code != -32601 {
+		t.Errorf("Error of node should be returned for gas price: %d %v", gasPrice, err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	cancelled := make(chan struct{}, 2)
+	release := make(chan struct{})
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		req, _ := json.GetRPCRequestFromJSON(string(b))
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-release:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":"0x1"}`))
+		}
+	}))
+	defer node.Close()
+	r := &RPC{NetType: "context"}
+	r.setPool(config.Chain{Urls: []string{node.URL}}, config.Default().RPC)
+	defer r.close()
+
+	// Deadline aborts the request to the node
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.GetCodeContext(ctx, "0x1"); err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Errorf("Request should end at deadline: %v in %s", err, time.Since(start))
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Request to node should be cancelled")
+	}
+	if n := r.getPool().nodes[0]; n.failures != 0 {
+		t.Errorf("Cancelled request should not be a failure of the node")
+	}
+
+	// Coalesced request goes on while another caller waits
+	req := initRPCRequest("eth_chainId")
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan string)
+	go func() {
+		resp, _ := r.DoRPC(req)
+		done <- resp
+	}()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		r.DoRPCContext(ctx, req)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	select {
+	case resp := <-done:
+		if json.GetRPCResponseFromJSON(resp).Result != "0x1" {
+			t.Errorf("Shared request should not be cancelled by a caller: %s", resp)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Shared request should be answered")
+	}
+
+	// Gas price and nonce give error of ctx instead of zero
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.GetGasPriceContext(ctx); err != context.Canceled {
+		t.Errorf("Gas price should fail with ctx: %v", err)
+	}
+	if _, err := r.GetTransactionCountContext(ctx, "0x1"); err != context.Canceled {
+		t.Errorf("Nonce should fail with ctx: %v", err)
+	}
+	if nonce, err := r.GetTransactionCountContext(context.Background(), "0x1"); nonce != 1 || err != nil {
+		t.Errorf("Failed to get nonce: %d %v", nonce, err)
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	// results are results of nodes, which can be changed during test
+	results := []string{`"0xAB"`, `"0xab"`, `"0x1"`}
+	var mu sync.Mutex
+	var urls []string
+	for i := range results {
+		node := httptest.NewServer(http.HandlerFunc(func(i int) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				result := results[i]
+				mu.Unlock()
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":` + result + `}`))
+			}
+		}(i)))
+		defer node.Close()
+		urls = append(urls, node.URL)
+	}
+	settings := config.Default().RPC
+	settings.QuorumMethods = []string{"eth_getBalance"}
+	r := &RPC{NetType: "quorum"}
+	r.setPool(config.Chain{Urls: urls}, settings)
+	defer r.close()
+
+	if r.Quorum("eth_getBalance") != 3 || r.Quorum("eth_call") != 0 {
+		t.Errorf("Quorum should follow methods")
+	}
+	req, _ := json.GetRPCRequestFromJSON(`{"jsonrpc":"2.0","method":"eth_getBalance","params":["0x1","latest"],"id":1}`)
+	resp, routes, err := r.DoRPCQuorum(req, 3)
+	if err != nil || len(routes) != 2 || routes[0].Node == upstreamLabel(urls[2]) || routes[1].Node == upstreamLabel(urls[2]) {
+		t.Fatalf("Majority should be returned: %s %+v %v", resp, routes, err)
+	}
+	var buf bytes.Buffer
+	metrics.GetInstance().WriteText(&buf)
+	if !strings.Contains(buf.String(), `eth_proxy_upstream_divergences_total{chain="quorum",upstream="`+upstreamLabel(urls[2])+`"} 1`) {
+		t.Errorf("Divergent node should be counted")
+	}
+
+	mu.Lock()
+	results[1] = `"0x2"`
+	mu.Unlock()
+	_, _, err = r.DoRPCQuorum(req, 3)
+	if rpcErr, ok := err.(*json.RPCError); !ok || rpcErr.Code != json.QuorumNotReachedCode {
+		t.Errorf("Disagreement should fail: %v", err)
+	}
+	if _, _, err = r.DoRPCQuorum(req, 7); err == nil {
+		t.Errorf("Quorum should not be reached by fewer nodes")
+	}
+
+	// Normalized regardless of id, key order and case of hex
+	a, _ := normalize(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0xAB","number":"0x1"}}`)
+	b, _ := normalize(`{"id":2,"result":{"number":"0x1","hash":"0xab"},"jsonrpc":"2.0"}`)
+	c, _ := normalize(`{"id":2,"error":{"code":-32000,"message":"header not found"}}`)
+	if a != b || c != "error:-32000" {
+		t.Errorf("Unexpected normalization: %s %s %s", a, b, c)
+	}
+}
@@ -5,6 +5,10 @@ var (
 	MainnetUrls = []string{""}
 	// TestnetUrls is a URL list for testnet
 	TestnetUrls = []string{""}
+	// MainnetWsUrls is a WebSocket URL list for mainnet, used for subscription
+	MainnetWsUrls = []string{""}
+	// TestnetWsUrls is a WebSocket URL list for testnet, used for subscription
+	TestnetWsUrls = []string{""}
 )
 
 // ContentType is a content-type for JSON-RPC
@@ -0,0 +1,385 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+
+	"golang.org/x/net/websocket"
+)
+
+// websocketOrigin is Origin used to dial WebSocket upstream
+const websocketOrigin = "http://localhost"
+
+// stream is a persistent connection carrying JSON-RPC messages
+type stream interface {
+	read() ([]byte, error)
+	write(msg []byte) error
+	Close() error
+}
+
+// dialer opens stream to a node
+type dialer func() (stream, error)
+
+// streamTransport multiplexes requests onto a persistent connection to a node
+// It is http.RoundTripper so that HTTP clients send requests through it as they are.
+// Ids of requests are replaced with ones unique in the connection and restored in responses,
+// and every other byte of messages is relayed as it is.
+type streamTransport struct {
+	dial dialer
+
+	// writeMu serializes writes to connection
+	writeMu sync.Mutex
+	// mu guards fields below
+	mu   sync.Mutex
+	conn stream
+	// id replaced => call waiting for response
+	pending map[uint64]*streamCall
+	lastID  uint64
+	// idle closes connection once no call is pending
+	idle bool
+}
+
+// streamCall is a request waiting for its response
+type streamCall struct {
+	// ids are id replaced => id of request
+	ids  map[uint64]json.RawMessage
+	done chan streamResult
+}
+
+type streamResult struct {
+	body []byte
+	err  error
+}
+
+// newStreamTransport returns transport dialing a node with dial on demand
+func newStreamTransport(dial dialer) *streamTransport {
+	return &streamTransport{dial: dial, pending: make(map[uint64]*streamCall)}
+}
+
+// RoundTrip sends body of the request and returns response of the node as HTTP response
+func (t *streamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.call(req.Context(), body)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {ContentType}},
+		Body:          ioutil.NopCloser(bytes.NewReader(resp)),
+		ContentLength: int64(len(resp)),
+		Request:       req,
+	}, nil
+}
+
+// call sends a request or batch and waits for its response until ctx is done
+// Notifications are not answered by node, so the response is empty without id
+func (t *streamTransport) call(ctx context.Context, body []byte) ([]byte, error) {
+	spans, err := findIDs(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %s", err)
+	}
+	c := &streamCall{ids: make(map[uint64]json.RawMessage), done: make(chan streamResult, 1)}
+
+	t.mu.Lock()
+	conn, err := t.connect()
+	if err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
+	ids := make([][]byte, len(spans))
+	for i, sp := range spans {
+		if id := body[sp.start:sp.end]; string(id) != "null" {
+			t.lastID++
+			c.ids[t.lastID] = append(json.RawMessage(nil), id...)
+			ids[i] = []byte(strconv.FormatUint(t.lastID, 10))
+			t.pending[t.lastID] = c
+		}
+	}
+	t.idle = false
+	t.mu.Unlock()
+
+	t.writeMu.Lock()
+	err = conn.write(replaceIDs(body, spans, ids))
+	t.writeMu.Unlock()
+	if err != nil {
+		// Connection may be replaced already, which leaves the call pending
+		t.forget(c)
+		t.fail(conn, err)
+		return nil, err
+	}
+	if len(c.ids) == 0 {
+		return []byte{}, nil
+	}
+	select {
+	case res := <-c.done:
+		return res.body, res.err
+	case <-ctx.Done():
+		t.forget(c)
+		return nil, ctx.Err()
+	}
+}
+
+// connect returns connection, dialing when it is not connected, which must be called with lock
+func (t *streamTransport) connect() (stream, error) {
+	if t.conn != nil {
+		return t.conn, nil
+	}
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	go t.readLoop(conn)
+	return conn, nil
+}
+
+// readLoop delivers responses read from the connection to calls until it fails
+func (t *streamTransport) readLoop(conn stream) {
+	for {
+		msg, err := conn.read()
+		if err != nil {
+			t.fail(conn, err)
+			return
+		}
+		t.dispatch(msg)
+	}
+}
+
+// dispatch gives the response to its call with ids restored
+// Notifications of subscriptions and responses of calls given up are dropped
+func (t *streamTransport) dispatch(msg []byte) {
+	spans, err := findIDs(msg)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	var c *streamCall
+	for _, sp := range spans {
+		if id, err := strconv.ParseUint(string(msg[sp.start:sp.end]), 10, 64); err == nil && t.pending[id] != nil {
+			c = t.pending[id]
+			break
+		}
+	}
+	if c == nil {
+		t.mu.Unlock()
+		return
+	}
+	ids := make([][]byte, len(spans))
+	for i, sp := range spans {
+		if id, err := strconv.ParseUint(string(msg[sp.start:sp.end]), 10, 64); err == nil {
+			ids[i] = c.ids[id]
+		}
+	}
+	t.release(c)
+	t.mu.Unlock()
+	c.done <- streamResult{body: replaceIDs(msg, spans, ids)}
+}
+
+// fail closes the connection and fails every call pending on it
+func (t *streamTransport) fail(conn stream, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != conn {
+		return
+	}
+	t.conn = nil
+	conn.Close()
+	calls := make(map[*streamCall]bool)
+	for id, c := range t.pending {
+		calls[c] = true
+		delete(t.pending, id)
+	}
+	for c := range calls {
+		c.done <- streamResult{err: err}
+	}
+}
+
+// forget gives up the call
+func (t *streamTransport) forget(c *streamCall) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.release(c)
+}
+
+// release removes the call from pending, which must be called with lock
+func (t *streamTransport) release(c *streamCall) {
+	for id := range c.ids {
+		delete(t.pending, id)
+	}
+	if t.idle && len(t.pending) == 0 && t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// CloseIdleConnections closes connection once calls pending on it are done
+// It is dialed again when a request comes later
+func (t *streamTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.idle = true
+	t.release(&streamCall{})
+}
+
+// idSpan is offsets of id value of a message in a body, which is body[start:end]
+type idSpan struct {
+	start, end int
+}
+
+// findIDs returns ids of a JSON-RPC message or every message of a batch in order
+// Messages without id, such as notifications, have no span.
+func findIDs(body []byte) ([]idSpan, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		start, end, err := ethjson.FindID(body)
+		if err != nil || start < 0 {
+			return nil, err
+		}
+		return []idSpan{{start, end}}, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	var spans []idSpan
+	for dec.More() {
+		var msg json.RawMessage
+		if err := dec.Decode(&msg); err != nil {
+			return nil, err
+		}
+		// Decoded message is always the exact bytes in front of the offset
+		offset := int(dec.InputOffset()) - len(msg)
+		start, end, err := ethjson.FindID(msg)
+		if err != nil {
+			return nil, err
+		}
+		if start >= 0 {
+			spans = append(spans, idSpan{offset + start, offset + end})
+		}
+	}
+	return spans, nil
+}
+
+// replaceIDs returns body whose ids at spans are replaced with ids of the same index
+// An id is kept when its replacement is nil, and every other byte is kept as it is.
+func replaceIDs(body []byte, spans []idSpan, ids [][]byte) []byte {
+	ret := make([]byte, 0, len(body))
+	last := 0
+	for i, sp := range spans {
+		if ids[i] == nil {
+			continue
+		}
+		ret = append(ret, body[last:sp.start]...)
+		ret = append(ret, ids[i]...)
+		last = sp.end
+	}
+	return append(ret, body[last:]...)
+}
+
+// websocketStream is a stream of WebSocket whose frame is a message
+type websocketStream struct {
+	conn *websocket.Conn
+}
+
+func (s websocketStream) read() (msg []byte, err error) {
+	err = websocket.Message.Receive(s.conn, &msg)
+	return
+}
+
+func (s websocketStream) write(msg []byte) error {
+	return websocket.Message.Send(s.conn, string(msg))
+}
+
+func (s websocketStream) Close() error {
+	return s.conn.Close()
+}
+
+// dialWebsocket returns dialer of WebSocket upstream
+func dialWebsocket(up config.Upstream, timeout time.Duration) dialer {
+	return func() (stream, error) {
+		conn, err := DialWebsocket(up, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return websocketStream{conn}, nil
+	}
+}
+
+// DialWebsocket connects to WebSocket upstream, whose headers and credentials are sent in handshake
+func DialWebsocket(up config.Upstream, timeout time.Duration) (*websocket.Conn, error) {
+	cfg, err := websocket.NewConfig(up.URL, websocketOrigin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid websocket url")
+	}
+	cfg.Header = make(http.Header)
+	if err = setHeader(cfg.Header, up, time.Now()); err != nil {
+		return nil, err
+	}
+	cfg.Dialer = &net.Dialer{Timeout: timeout}
+	conn, err := websocket.DialConfig(cfg)
+	if err != nil {
+		// Error having URL may expose credentials in it
+		if e, ok := err.(*websocket.DialError); ok {
+			err = e.Err
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ipcStream is a stream of unix socket carrying JSON messages in a row
+type ipcStream struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+func (s ipcStream) read() ([]byte, error) {
+	var msg json.RawMessage
+	err := s.dec.Decode(&msg)
+	return msg, err
+}
+
+func (s ipcStream) write(msg []byte) error {
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+func (s ipcStream) Close() error {
+	return s.conn.Close()
+}
+
+// dialIPC returns dialer of IPC upstream at path
+func dialIPC(path string, timeout time.Duration) dialer {
+	return func() (stream, error) {
+		conn, err := net.DialTimeout("unix", path, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return ipcStream{conn: conn, dec: json.NewDecoder(conn)}, nil
+	}
+}
@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+)
+
+// upstreamTransport sets headers and authentication of an upstream to requests
+type upstreamTransport struct {
+	upstream config.Upstream
+	base     http.RoundTripper
+	now      func() time.Time
+}
+
+// newUpstreamClient returns HTTP client of the upstream
+// An HTTP upstream is reached through base transport, and WebSocket and IPC ones
+// through their own persistent connections. Timeout of the upstream precedes timeout given in second.
+func newUpstreamClient(up config.Upstream, base http.RoundTripper, timeout int) *http.Client {
+	if up.Timeout > 0 {
+		timeout = up.Timeout
+	}
+	d := time.Duration(timeout) * time.Second
+	var t http.RoundTripper = &upstreamTransport{upstream: up, base: base, now: time.Now}
+	if u, err := url.Parse(up.URL); err == nil {
+		switch u.Scheme {
+		case "ws", "wss":
+			t = newStreamTransport(dialWebsocket(up, d))
+		case "unix":
+			t = newStreamTransport(dialIPC(u.Path, d))
+		}
+	}
+	return &http.Client{Timeout: d, Transport: t}
+}
+
+// RoundTrip sends the request having headers and credentials of the upstream
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	up := t.upstream
+	// RoundTripper must not modify the request given
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+len(up.Headers)+1)
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	if err := setHeader(r.Header, up, t.now()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(r)
+}
+
+// setHeader sets headers and credentials of the upstream to h
+func setHeader(h http.Header, up config.Upstream, now time.Time) error {
+	for k, v := range up.Headers {
+		h.Set(k, v)
+	}
+	switch up.Auth {
+	case config.AuthBasic:
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(up.Username+":"+up.Password)))
+	case config.AuthBearer:
+		h.Set("Authorization", "Bearer "+up.Token)
+	case config.AuthProjectSecret:
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":"+up.Token)))
+	case config.AuthJWT:
+		token, err := signJWT(up.Token, now)
+		if err != nil {
+			return err
+		}
+		h.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// CloseIdleConnections closes idle connections of base transport
+func (t *upstreamTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// jwtHeader is a header of JWT signed by HMAC SHA-256
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signJWT returns JWT issued at now signed with secret in hex
+// A token is made for every request since nodes accept tokens issued recently only
+func signJWT(secret string, now time.Time) (string, error) {
+	key, err := hex.DecodeString(strings.TrimPrefix(secret, "0x"))
+	if err != nil {
+		return "", fmt.Errorf("invalid jwt secret")
+	}
+	claims, err := json.Marshal(map[string]int64{"iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,396 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+	"github.com/hexoul/aws-lambda-eth-proxy/rpc"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// Timeout of a call to upstream in second
+	callTimeout = 5
+	// Timeout to dial upstream in second
+	dialTimeout = 5
+	// Maximum interval to retry resubscription in second
+	maxRetryInterval = 30
+)
+
+// topics supported by eth_subscribe
+var topics = map[string]bool{
+	"newHeads":               true,
+	"logs":                   true,
+	"newPendingTransactions": true,
+}
+
+// topic is a single upstream subscription shared by clients
+type topic struct {
+	// key is params in JSON identifying the topic
+	key        string
+	params     []interface{}
+	upstreamID string
+	// conn is the upstream connection where the subscription lives
+	conn *websocket.Conn
+	// client subscription ID => client
+	subscribers map[string]*client
+}
+
+// upstreamMsg is either a response or a notification from upstream
+type upstreamMsg struct {
+	ID     json.RawMessage     `json:"id"`
+	Method string              `json:"method"`
+	Params *subscriptionParams `json:"params"`
+	Result json.RawMessage     `json:"result"`
+	Error  *ethjson.RPCError   `json:"error"`
+}
+
+// Hub multiplexes client subscriptions onto one upstream subscription per topic
+type Hub struct {
+	upstream func() config.Upstream
+
+	// manageMu serializes subscribe, unsubscribe and swaps of resubscribe
+	manageMu sync.Mutex
+	// mu guards maps below
+	mu sync.RWMutex
+	// topic key => topic
+	topics map[string]*topic
+	// upstream subscription ID => topic
+	upstreamIDs map[string]*topic
+	// client subscription ID => topic
+	clientIDs map[string]*topic
+
+	connMu  sync.Mutex
+	conn    *websocket.Conn
+	pending map[string]chan *upstreamMsg
+	lastID  uint64
+}
+
+// NewHub returns Hub dialing upstream given by upstream with its headers and credentials
+func NewHub(upstream func() config.Upstream) *Hub {
+	return &Hub{
+		upstream:    upstream,
+		topics:      make(map[string]*topic),
+		upstreamIDs: make(map[string]*topic),
+		clientIDs:   make(map[string]*topic),
+		pending:     make(map[string]chan *upstreamMsg),
+	}
+}
+
+// Subscribe registers client to a topic given by eth_subscribe params
+// and returns subscription ID for the client
+func (h *Hub) Subscribe(c *client, params []interface{}) (string, *ethjson.RPCError) {
+	if len(params) == 0 {
+		return "", ethjson.NewInvalidParams("topic is missing")
+	}
+	if name, ok := params[0].(string); !ok || !topics[name] {
+		return "", ethjson.NewInvalidParams(fmt.Sprintf("unsupported topic %v", params[0]))
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return "", ethjson.NewInvalidParams(err.Error())
+	}
+	key := string(b)
+
+	h.manageMu.Lock()
+	defer h.manageMu.Unlock()
+
+	h.mu.RLock()
+	t := h.topics[key]
+	h.mu.RUnlock()
+	if t == nil {
+		// First subscriber of the topic subscribes upstream
+		upstreamID, conn, err := h.subscribeUpstream(params)
+		if err != nil {
+			return "", ethjson.NewUpstreamError(err)
+		}
+		t = &topic{
+			key:         key,
+			params:      params,
+			upstreamID:  upstreamID,
+			conn:        conn,
+			subscribers: make(map[string]*client),
+		}
+		h.mu.Lock()
+		h.topics[key] = t
+		h.upstreamIDs[upstreamID] = t
+		h.mu.Unlock()
+		log.Infof("ws: subscribed %s upstream as %s", key, upstreamID)
+	}
+
+	id := newSubscriptionID()
+	h.mu.Lock()
+	t.subscribers[id] = c
+	h.clientIDs[id] = t
+	h.mu.Unlock()
+	return id, nil
+}
+
+// Unsubscribe removes client subscription
+// Upstream subscription is also removed when it has no subscriber
+func (h *Hub) Unsubscribe(c *client, id string) bool {
+	h.manageMu.Lock()
+	defer h.manageMu.Unlock()
+
+	h.mu.Lock()
+	t := h.clientIDs[id]
+	if t == nil || t.subscribers[id] != c {
+		h.mu.Unlock()
+		return false
+	}
+	delete(t.subscribers, id)
+	delete(h.clientIDs, id)
+	last := len(t.subscribers) == 0
+	if last {
+		for k, v := range h.topics {
+			if v == t {
+				delete(h.topics, k)
+			}
+		}
+		delete(h.upstreamIDs, t.upstreamID)
+	}
+	h.mu.Unlock()
+
+	if last {
+		if _, _, err := h.call("eth_unsubscribe", []interface{}{t.upstreamID}); err != nil {
+			log.Warnf("ws: failed to unsubscribe upstream %s: %s", t.upstreamID, err)
+		}
+	}
+	return true
+}
+
+// Reconnect drops upstream connection to resubscribe every topic on a new one
+// It should be called when upstream URLs are changed
+func (h *Hub) Reconnect() {
+	h.connMu.Lock()
+	conn := h.conn
+	h.connMu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// subscribeUpstream invokes eth_subscribe to upstream
+// and returns its ID with the connection where it lives
+func (h *Hub) subscribeUpstream(params []interface{}) (upstreamID string, conn *websocket.Conn, err error) {
+	var result json.RawMessage
+	if result, conn, err = h.call("eth_subscribe", params); err != nil {
+		return
+	}
+	err = json.Unmarshal(result, &upstreamID)
+	return
+}
+
+// connect returns upstream connection, dialing when it is not connected
+func (h *Hub) connect() (*websocket.Conn, error) {
+	h.connMu.Lock()
+	defer h.connMu.Unlock()
+	if h.conn != nil {
+		return h.conn, nil
+	}
+
+	up := h.upstream()
+	conn, err := rpc.DialWebsocket(up, dialTimeout*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	h.conn = conn
+	go h.readLoop(conn)
+	log.Info("ws: connected to upstream ", up)
+	return conn, nil
+}
+
+// call invokes JSON-RPC to upstream and waits for its result
+func (h *Hub) call(method string, params []interface{}) (json.RawMessage, *websocket.Conn, error) {
+	conn, err := h.connect()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&h.lastID, 1), 10)
+	req := ethjson.RPCRequest{
+		Jsonrpc: ethjson.Version,
+		Method:  method,
+		Params:  params,
+		ID:      []byte(id),
+	}
+	ch := make(chan *upstreamMsg, 1)
+	h.connMu.Lock()
+	h.pending[id] = ch
+	err = websocket.Message.Send(conn, req.String())
+	h.connMu.Unlock()
+	if err != nil {
+		h.dropPending(id)
+		return nil, nil, err
+	}
+
+	select {
+	case msg := <-ch:
+		if msg == nil {
+			return nil, nil, fmt.Errorf("upstream connection closed")
+		}
+		if msg.Error != nil {
+			return nil, nil, msg.Error
+		}
+		return msg.Result, conn, nil
+	case <-time.After(callTimeout * time.Second):
+		h.dropPending(id)
+		return nil, nil, timeoutError{}
+	}
+}
+
+func (h *Hub) dropPending(id string) {
+	h.connMu.Lock()
+	delete(h.pending, id)
+	h.connMu.Unlock()
+}
+
+// readLoop dispatches messages from upstream until the connection is closed
+func (h *Hub) readLoop(conn *websocket.Conn) {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			log.Warn("ws: upstream connection closed, ", err)
+			break
+		}
+
+		var msg upstreamMsg
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		if msg.Method == "eth_subscription" && msg.Params != nil {
+			h.dispatch(msg.Params)
+			continue
+		}
+
+		h.connMu.Lock()
+		id := string(msg.ID)
+		ch := h.pending[id]
+		delete(h.pending, id)
+		h.connMu.Unlock()
+		if ch != nil {
+			ch <- &msg
+		}
+	}
+
+	// Fail pending calls and resubscribe on a new connection
+	conn.Close()
+	h.connMu.Lock()
+	if h.conn == conn {
+		h.conn = nil
+	}
+	for id, ch := range h.pending {
+		close(ch)
+		delete(h.pending, id)
+	}
+	h.connMu.Unlock()
+	go h.resubscribe()
+}
+
+// dispatch fans out upstream notification to every subscriber of the topic
+func (h *Hub) dispatch(params *subscriptionParams) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	t := h.upstreamIDs[params.Subscription]
+	if t == nil {
+		return
+	}
+	for id, c := range t.subscribers {
+		c.notify(id, params.Result)
+	}
+}
+
+// resubscribe subscribes every topic living on a closed connection again
+// until it succeeds or no topic is left
+// manageMu is held only to swap a topic, so clients may subscribe and unsubscribe while it retries
+func (h *Hub) resubscribe() {
+	for interval := 1; ; interval *= 2 {
+		ts := h.staleTopics()
+		if len(ts) == 0 {
+			return
+		}
+
+		failed := false
+		for _, t := range ts {
+			upstreamID, conn, err := h.subscribeUpstream(t.params)
+			if err != nil {
+				log.Warn("ws: failed to resubscribe, ", err)
+				failed = true
+				break
+			}
+			h.manageMu.Lock()
+			h.mu.Lock()
+			// Topic may be unsubscribed or resubscribed by another attempt meanwhile
+			swapped := h.topics[t.key] == t && t.conn != conn
+			if swapped {
+				delete(h.upstreamIDs, t.upstreamID)
+				t.upstreamID = upstreamID
+				t.conn = conn
+				h.upstreamIDs[upstreamID] = t
+			}
+			h.mu.Unlock()
+			h.manageMu.Unlock()
+			if !swapped {
+				if _, _, err := h.call("eth_unsubscribe", []interface{}{upstreamID}); err != nil {
+					log.Warnf("ws: failed to unsubscribe upstream %s: %s", upstreamID, err)
+				}
+			}
+		}
+		if !failed {
+			log.Infof("ws: resubscribed %d topics", len(ts))
+			return
+		}
+
+		if interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// staleTopics returns topics not living on the current connection
+func (h *Hub) staleTopics() []*topic {
+	h.connMu.Lock()
+	current := h.conn
+	h.connMu.Unlock()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ts := make([]*topic, 0, len(h.topics))
+	for _, t := range h.topics {
+		if current == nil || t.conn != current {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// removeClient unsubscribes every subscription of the client
+func (h *Hub) removeClient(c *client) {
+	h.mu.RLock()
+	var ids []string
+	for id, t := range h.clientIDs {
+		if t.subscribers[id] == c {
+			ids = append(ids, id)
+		}
+	}
+	h.mu.RUnlock()
+	for _, id := range ids {
+		h.Unsubscribe(c, id)
+	}
+}
+
+// timeoutError is a net.Error to be classified as upstream timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "upstream call timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,199 @@
+// Package ws serves JSON-RPC over WebSocket including eth_subscribe
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/common"
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+	"github.com/hexoul/aws-lambda-eth-proxy/log"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// Size of outgoing message queue per client
+	// A client is dropped when it cannot keep up with notifications
+	sendQueueSize = 256
+)
+
+// subscriptionParams is params of eth_subscription notification
+type subscriptionParams struct {
+	Subscription string          `json:"subscription"`
+	Result       json.RawMessage `json:"result"`
+}
+
+// notification is a message pushed to subscriber
+type notification struct {
+	Jsonrpc string             `json:"jsonrpc"`
+	Method  string             `json:"method"`
+	Params  subscriptionParams `json:"params"`
+}
+
+// Server serves WebSocket clients
+// Subscription methods are handled by Hub and the others by forward
+type Server struct {
+	hub *Hub
+	// forward handles JSON-RPC request body and returns response body
+	forward func(ctx context.Context, body string) string
+	// admit returns RPCError when eth_subscribe is not allowed
+	admit func(ctx context.Context, req ethjson.RPCRequest) *ethjson.RPCError
+}
+
+// client is a WebSocket connection of subscriber
+type client struct {
+	conn *websocket.Conn
+	out  chan []byte
+	once sync.Once
+	done chan struct{}
+}
+
+// NewServer returns WebSocket Server
+// ctx given to forward and admit is the context of HTTP upgrade request
+func NewServer(hub *Hub, forward func(ctx context.Context, body string) string, admit func(ctx context.Context, req ethjson.RPCRequest) *ethjson.RPCError) *Server {
+	return &Server{
+		hub:     hub,
+		forward: forward,
+		admit:   admit,
+	}
+}
+
+// ServeHTTP upgrades HTTP request to WebSocket
+// Every origin is accepted because non-browser clients do not send it
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{
+		Handler:   s.serveConn,
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+	}.ServeHTTP(w, r)
+}
+
+// serveConn reads requests from client until the connection is closed
+func (s *Server) serveConn(conn *websocket.Conn) {
+	c := &client{
+		conn: conn,
+		out:  make(chan []byte, sendQueueSize),
+		done: make(chan struct{}),
+	}
+	go c.writeLoop()
+	defer func() {
+		c.close()
+		s.hub.removeClient(c)
+	}()
+
+	for {
+		var msg string
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			return
+		}
+		// Handle each message concurrently not to block subscriptions
+		go func(msg string) {
+			if resp := s.handle(c, msg); resp != "" {
+				c.send([]byte(resp))
+			}
+		}(msg)
+	}
+}
+
+// handle returns response body for a message from client
+func (s *Server) handle(c *client, msg string) string {
+	ctx := c.conn.Request().Context()
+	req, rpcErr := ethjson.GetRPCRequestFromJSON(msg)
+	if rpcErr != nil || (req.Method != "eth_subscribe" && req.Method != "eth_unsubscribe") {
+		// Including batch and invalid request
+		return s.forward(ctx, msg)
+	}
+
+	resp := ethjson.RPCResponse{
+		Jsonrpc: ethjson.Version,
+		ID:      req.ID,
+	}
+	switch req.Method {
+	case "eth_subscribe":
+		if rpcErr = s.admit(ctx, req); rpcErr != nil {
+			break
+		}
+		var id string
+		if id, rpcErr = s.hub.Subscribe(c, req.Params); rpcErr == nil {
+			resp.Result = id
+		}
+	case "eth_unsubscribe":
+		id, ok := "", len(req.Params) == 1
+		if ok {
+			id, ok = req.Params[0].(string)
+		}
+		if !ok {
+			rpcErr = ethjson.NewInvalidParams("subscription id is needed")
+			break
+		}
+		resp.Result = s.hub.Unsubscribe(c, id)
+	}
+	if rpcErr != nil {
+		log.Error(rpcErr.Error())
+		resp.Error = rpcErr
+	}
+	if req.IsNotification() {
+		return ""
+	}
+	return resp.String()
+}
+
+// send queues message to client, dropping the client when its queue is full
+func (c *client) send(msg []byte) {
+	select {
+	case c.out <- msg:
+	case <-c.done:
+	default:
+		log.Warn("ws: drop slow client ", c.conn.Request().RemoteAddr)
+		c.close()
+	}
+}
+
+// notify sends eth_subscription notification to client
+func (c *client) notify(id string, result json.RawMessage) {
+	msg, err := json.Marshal(notification{
+		Jsonrpc: ethjson.Version,
+		Method:  "eth_subscription",
+		Params: subscriptionParams{
+			Subscription: id,
+			Result:       result,
+		},
+	})
+	if err == nil {
+		c.send(msg)
+	}
+}
+
+func (c *client) writeLoop() {
+	for {
+		select {
+		case msg := <-c.out:
+			if err := websocket.Message.Send(c.conn, string(msg)); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// newSubscriptionID returns random hex ID like geth does
+func newSubscriptionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return hexutil.EncodeUint64(common.RandomUint64())
+	}
+	return hexutil.Encode(b)
+}
@@ -0,0 +1,284 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hexoul/aws-lambda-eth-proxy/config"
+	ethjson "github.com/hexoul/aws-lambda-eth-proxy/json"
+
+	"golang.org/x/net/websocket"
+)
+
+// testUpstream imitates ethereum node serving WebSocket
+type testUpstream struct {
+	sync.Mutex
+	server     *httptest.Server
+	conns      []*websocket.Conn
+	headers    []http.Header
+	subscribed []string
+	lastID     int
+}
+
+func newTestUpstream() *testUpstream {
+	u := &testUpstream{}
+	u.server = httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		u.Lock()
+		u.conns = append(u.conns, conn)
+		u.headers = append(u.headers, conn.Request().Header)
+		u.Unlock()
+		for {
+			var msg string
+			if err := websocket.Message.Receive(conn, &msg); err != nil {
+				return
+			}
+			req, _ := ethjson.GetRPCRequestFromJSON(msg)
+			resp := ethjson.RPCResponse{Jsonrpc: "2.0", ID: req.ID}
+			switch req.Method {
+			case "eth_subscribe":
+				u.Lock()
+				u.lastID++
+				resp.Result = fmt.Sprintf("0xup%d", u.lastID)
+				u.subscribed = append(u.subscribed, req.Params[0].(string))
+				u.Unlock()
+			case "eth_unsubscribe":
+				resp.Result = true
+			}
+			websocket.Message.Send(conn, resp.String())
+		}
+	}))
+	return u
+}
+
+// upstream returns the upstream having headers and credentials to be sent in handshake
+func (u *testUpstream) upstream() config.Upstream {
+	return config.Upstream{
+		URL:     "ws" + strings.TrimPrefix(u.server.URL, "http"),
+		Headers: map[string]string{"X-Client": "proxy"},
+		Auth:    config.AuthBearer,
+		Token:   "secret",
+	}
+}
+
+// push sends notification to every upstream connection
+func (u *testUpstream) push(upstreamID, result string) {
+	u.Lock()
+	defer u.Unlock()
+	msg := fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"%s","result":%s}}`, upstreamID, result)
+	for _, conn := range u.conns {
+		websocket.Message.Send(conn, msg)
+	}
+}
+
+// drop closes every upstream connection
+func (u *testUpstream) drop() {
+	u.Lock()
+	defer u.Unlock()
+	for _, conn := range u.conns {
+		conn.Close()
+	}
+	u.conns = nil
+}
+
+func (u *testUpstream) subscribeCount() int {
+	u.Lock()
+	defer u.Unlock()
+	return len(u.subscribed)
+}
+
+func newTestServer(u *testUpstream) *httptest.Server {
+	hub := NewHub(u.upstream)
+	forward := func(ctx context.Context, body string) string {
+		req, _ := ethjson.GetRPCRequestFromJSON(body)
+		resp := ethjson.RPCResponse{Jsonrpc: "2.0", ID: req.ID, Result: "0x10"}
+		return resp.String()
+	}
+	admit := func(ctx context.Context, req ethjson.RPCRequest) *ethjson.RPCError {
+		if len(req.Params) > 0 && req.Params[0] == "denied" {
+			return ethjson.NewRPCError(ethjson.ForbiddenCode, nil)
+		}
+		return nil
+	}
+	return httptest.NewServer(NewServer(hub, forward, admit))
+}
+
+func dial(t *testing.T, s *httptest.Server) *websocket.Conn {
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(s.URL, "http"), "", "http://localhost")
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	return conn
+}
+
+func request(t *testing.T, conn *websocket.Conn, msg string) ethjson.RPCResponse {
+	if err := websocket.Message.Send(conn, msg); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	return receive(t, conn)
+}
+
+func receive(t *testing.T, conn *websocket.Conn) ethjson.RPCResponse {
+	var resp string
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if err := websocket.Message.Receive(conn, &resp); err != nil {
+		t.Fatalf("Failed to receive: %s", err)
+	}
+	return ethjson.GetRPCResponseFromJSON(resp)
+}
+
+func receiveNotification(t *testing.T, conn *websocket.Conn) notification {
+	var msg string
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if err := websocket.Message.Receive(conn, &msg); err != nil {
+		t.Fatalf("Failed to receive notification: %s", err)
+	}
+	var n notification
+	json.Unmarshal([]byte(msg), &n)
+	return n
+}
+
+func TestRequest(t *testing.T) {
+	u := newTestUpstream()
+	defer u.server.Close()
+	s := newTestServer(u)
+	defer s.Close()
+
+	conn := dial(t, s)
+	defer conn.Close()
+	resp := request(t, conn, `{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":"a"}`)
+	if string(resp.ID) != `"a"` || resp.Result != "0x10" {
+		t.Errorf("Failed to forward request over WebSocket: %v", resp)
+	}
+
+	resp = request(t, conn, `{"jsonrpc":"2.0","method":"eth_subscribe","params":["syncing"],"id":1}`)
+	if resp.Error == nil || resp.Error.Code != ethjson.InvalidParamsCode {
+		t.Errorf("Unsupported topic should be rejected: %v", resp)
+	}
+
+	resp = request(t, conn, `{"jsonrpc":"2.0","method":"eth_subscribe","params":["denied"],"id":2}`)
+	if resp.Error == nil || resp.Error.Code != ethjson.ForbiddenCode {
+		t.Errorf("Subscription should be admitted first: %v", resp)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	u := newTestUpstream()
+	defer u.server.Close()
+	s := newTestServer(u)
+	defer s.Close()
+
+	// Two clients share one upstream subscription
+	conn1, conn2 := dial(t, s), dial(t, s)
+	defer conn1.Close()
+	defer conn2.Close()
+	sub1 := request(t, conn1, `{"jsonrpc":"2.0","method":"eth_subscribe","params":["newHeads"],"id":1}`)
+	sub2 := request(t, conn2, `{"jsonrpc":"2.0","method":"eth_subscribe","params":["newHeads"],"id":2}`)
+	if sub1.Error != nil || sub2.Error != nil || sub1.Result == sub2.Result {
+		t.Fatalf("Failed to subscribe: %v %v", sub1, sub2)
+	}
+	if cnt := u.subscribeCount(); cnt != 1 {
+		t.Fatalf("Upstream subscription should be shared: %d", cnt)
+	}
+
+	u.push("0xup1", `{"number":"0x1"}`)
+	n1, n2 := receiveNotification(t, conn1), receiveNotification(t, conn2)
+	if n1.Params.Subscription != sub1.Result || n2.Params.Subscription != sub2.Result {
+		t.Errorf("Notification should carry client subscription id: %v %v", n1, n2)
+	}
+	if string(n1.Params.Result) != `{"number":"0x1"}` {
+		t.Errorf("Notification result is changed: %s", n1.Params.Result)
+	}
+
+	// Different topic has its own upstream subscription
+	resp := request(t, conn1, `{"jsonrpc":"2.0","method":"eth_subscribe","params":["logs",{"address":"0x1"}],"id":3}`)
+	if resp.Error != nil || u.subscribeCount() != 2 {
+		t.Errorf("Failed to subscribe logs: %v", resp)
+	}
+
+	// Unsubscribe
+	resp = request(t, conn2, fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_unsubscribe","params":["%s"],"id":4}`, sub1.Result))
+	if resp.Result != false {
+		t.Errorf("Client should not unsubscribe others: %v", resp)
+	}
+	resp = request(t, conn2, fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_unsubscribe","params":["%s"],"id":5}`, sub2.Result))
+	if resp.Result != true {
+		t.Errorf("Failed to unsubscribe: %v", resp)
+	}
+}
+
+func TestResubscribe(t *testing.T) {
+	u := newTestUpstream()
+	defer u.server.Close()
+	s := newTestServer(u)
+	defer s.Close()
+
+	conn := dial(t, s)
+	defer conn.Close()
+	sub := request(t, conn, `{"jsonrpc":"2.0","method":"eth_subscribe","params":["newPendingTransactions"],"id":1}`)
+	if sub.Error != nil {
+		t.Fatalf("Failed to subscribe: %v", sub)
+	}
+
+	// Upstream goes away and comes back with a new subscription
+	u.drop()
+	for i := 0; i < 30 && u.subscribeCount() < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if u.subscribeCount() != 2 {
+		t.Fatalf("Failed to resubscribe")
+	}
+
+	u.push("0xup2", `"0xabc"`)
+	n := receiveNotification(t, conn)
+	if n.Params.Subscription != sub.Result || string(n.Params.Result) != `"0xabc"` {
+		t.Errorf("Subscription should survive upstream change: %v", n)
+	}
+}
+
+func TestResubscribeUnsubscribe(t *testing.T) {
+	u := newTestUpstream()
+	s := newTestServer(u)
+	defer s.Close()
+
+	conn := dial(t, s)
+	defer conn.Close()
+	sub := request(t, conn, `{"jsonrpc":"2.0","method":"eth_subscribe","params":["newHeads"],"id":1}`)
+	if sub.Error != nil {
+		t.Fatalf("Failed to subscribe: %v", sub)
+	}
+
+	// Upstream goes away for good, while clients are still served
+	u.server.Close()
+	u.drop()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	resp := request(t, conn, fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_unsubscribe","params":["%s"],"id":2}`, sub.Result))
+	if resp.Result != true || time.Since(start) > time.Second {
+		t.Errorf("Unsubscribe should not wait for resubscription: %v in %s", resp, time.Since(start))
+	}
+}
+
+func TestUpstreamHeader(t *testing.T) {
+	u := newTestUpstream()
+	defer u.server.Close()
+	s := newTestServer(u)
+	defer s.Close()
+
+	conn := dial(t, s)
+	defer conn.Close()
+	if sub := request(t, conn, `{"jsonrpc":"2.0","method":"eth_subscribe","params":["newHeads"],"id":1}`); sub.Error != nil {
+		t.Fatalf("Failed to subscribe: %v", sub)
+	}
+	u.Lock()
+	defer u.Unlock()
+	if len(u.headers) != 1 || u.headers[0].Get("Authorization") != "Bearer secret" || u.headers[0].Get("X-Client") != "proxy" {
+		t.Errorf("Headers and credentials of upstream should be sent in handshake: %v", u.headers)
+	}
+}